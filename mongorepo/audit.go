@@ -0,0 +1,121 @@
+package mongorepo
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	CreatedByField = "createdBy"
+	UpdatedByField = "updatedBy"
+)
+
+var ErrNoActor = errors.New("no actor in context")
+
+type auditConfig struct {
+	actorKey any
+	require  bool
+}
+
+//开启审计：写入时从ctx中用actorKey取出操作者，插入时写入createdBy和updatedBy，更新时写入updatedBy并保留原来的createdBy。
+//ctx中没有操作者时插入不写这两个字段、更新保留库里原来的值，require为true时则返回ErrNoActor且不写入。
+//整个文档替换的写入（SaveAll的更新、UpdateIfPresent、SaveIf、持久化的结构升级）都会带上库里原来的审计字段
+func (store *MongodbStore[T]) SetAuditActorKey(actorKey any, require bool) {
+	store.audit = &auditConfig{actorKey, require}
+}
+
+func (store *MongodbStore[T]) auditActor(ctx context.Context) (any, error) {
+	if store.audit == nil {
+		return nil, nil
+	}
+	actor := ctx.Value(store.audit.actorKey)
+	if actor == nil && store.audit.require {
+		return nil, ErrNoActor
+	}
+	return actor, nil
+}
+
+func (store *MongodbStore[T]) stampInsert(doc any, actor any) (any, error) {
+	if actor == nil {
+		return doc, nil
+	}
+	d, err := store.toBsonD(doc)
+	if err != nil {
+		return nil, err
+	}
+	d = setField(d, CreatedByField, actor)
+	d = setField(d, UpdatedByField, actor)
+	return d, nil
+}
+
+//整个文档替换之前调用，实体中没有的审计字段带上库里原来的文档stored中的值
+func (store *MongodbStore[T]) carryAudit(doc any, stored bson.Raw) (any, error) {
+	if store.audit == nil || stored == nil {
+		return doc, nil
+	}
+	d, err := store.toBsonD(doc)
+	if err != nil {
+		return nil, err
+	}
+	return carryAuditFields(d, stored), nil
+}
+
+//整个文档替换之前调用，有操作者时写入updatedBy
+func (store *MongodbStore[T]) stampUpdate(doc any, actor any) (any, error) {
+	if store.audit == nil || actor == nil {
+		return doc, nil
+	}
+	d, err := store.toBsonD(doc)
+	if err != nil {
+		return nil, err
+	}
+	return setField(d, UpdatedByField, actor), nil
+}
+
+func carryAuditFields(d bson.D, stored bson.Raw) bson.D {
+	for _, field := range []string{CreatedByField, UpdatedByField} {
+		if hasField(d, field) {
+			continue
+		}
+		if value, err := stored.LookupErr(field); err == nil {
+			d = append(d, bson.E{field, value})
+		}
+	}
+	return d
+}
+
+func (store *MongodbStore[T]) toBsonD(doc any) (bson.D, error) {
+	if d, ok := doc.(bson.D); ok {
+		return d, nil
+	}
+	raw, err := bson.MarshalWithRegistry(store.registry, doc)
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err = bson.Unmarshal(raw, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func hasField(d bson.D, key string) bool {
+	for _, e := range d {
+		if e.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func setField(d bson.D, key string, value any) bson.D {
+	for i, e := range d {
+		if e.Key == key {
+			d[i].Value = value
+			return d
+		}
+	}
+	return append(d, bson.E{key, value})
+}
@@ -0,0 +1,46 @@
+package mongorepo_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+)
+
+type actorKey struct{}
+
+func TestAuditFields(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	coll := client.Database(testDatabase).Collection(testCollection(t, client))
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	store.SetAuditActorKey(actorKey{}, false)
+	auditOf := func() (createdBy, updatedBy any) {
+		_, raw, _, err := store.LoadRaw(ctx, "a")
+		if err != nil {
+			t.Fatalf("LoadRaw: %v", err)
+		}
+		return raw[mongorepo.CreatedByField], raw[mongorepo.UpdatedByField]
+	}
+	if err := store.Save(context.WithValue(ctx, actorKey{}, "alice"), "a", &testOrder{"a", "new", 1}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if createdBy, updatedBy := auditOf(); createdBy != "alice" || updatedBy != "alice" {
+		t.Fatalf("after insert: createdBy=%v updatedBy=%v", createdBy, updatedBy)
+	}
+	store.UpdateIfPresent(context.WithValue(ctx, actorKey{}, "bob"), "a", &testOrder{"a", "paid", 1})
+	if createdBy, updatedBy := auditOf(); createdBy != "alice" || updatedBy != "bob" {
+		t.Fatalf("after update: createdBy=%v updatedBy=%v", createdBy, updatedBy)
+	}
+	//没有操作者时保留原来的值
+	store.UpdateIfPresent(ctx, "a", &testOrder{"a", "done", 1})
+	if createdBy, updatedBy := auditOf(); createdBy != "alice" || updatedBy != "bob" {
+		t.Fatalf("after update without actor: createdBy=%v updatedBy=%v", createdBy, updatedBy)
+	}
+
+	store.SetAuditActorKey(actorKey{}, true)
+	if _, err := store.UpdateIfPresent(ctx, "a", &testOrder{"a", "done", 2}); !errors.Is(err, mongorepo.ErrNoActor) {
+		t.Fatalf("required actor missing: %v, want ErrNoActor", err)
+	}
+}
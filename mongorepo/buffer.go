@@ -0,0 +1,147 @@
+package mongorepo
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type writeBuffer struct {
+	mutex      sync.Mutex
+	pending    []mongo.WriteModel
+	maxPending int
+	//读之前的写入失败时的错误，由之后的Flush返回
+	deferredErr error
+	//同一时间只有一个BulkWrite，后来的Flush要等前一个写完，才能保证Flush返回时之前的写入都已落库
+	flushMutex sync.Mutex
+}
+
+//开启写缓冲：Save不再立即写库，而是放入缓冲，缓冲满maxPending条或者调用Flush时用一次BulkWrite写入。
+//注意：缓冲中的数据在Flush之前没有持久化，进程崩溃会丢失，Save返回nil也不代表已经写入，写入错误会在触发写入的Save或Flush中返回。
+//Load、LoadRaw、LoadAll之前会先写入缓冲，所以通过仓库Take、Find能看到缓冲中的写入；这时写入失败的话读不会返回错误，
+//但可能看不到缓冲中的写入，错误留给之后的Flush（包括缓冲满时Save触发的）或Close返回，有多个时只保留第一个。
+//SaveAll、RemoveAll之前也会先写入缓冲，这次写入的错误由它们返回。
+//MongodbRepository上直接查库的方法（QueryAllByField、Count等）看不到缓冲中的写入，需要的话先调用Flush。
+//不再使用store时需要调用Close，以写入剩余的缓冲
+func (store *MongodbStore[T]) EnableWriteBuffer(maxPending int) {
+	store.writeBuffer = &writeBuffer{maxPending: maxPending}
+}
+
+func (store *MongodbStore[T]) enqueue(ctx context.Context, model mongo.WriteModel) error {
+	wb := store.writeBuffer
+	wb.mutex.Lock()
+	wb.pending = append(wb.pending, model)
+	full := wb.maxPending > 0 && len(wb.pending) >= wb.maxPending
+	wb.mutex.Unlock()
+	if full {
+		return store.Flush(ctx)
+	}
+	return nil
+}
+
+//把缓冲中的写入用一次BulkWrite写到库里。之前读的时候写入失败的错误也在这里返回
+func (store *MongodbStore[T]) Flush(ctx context.Context) error {
+	wb := store.writeBuffer
+	if wb == nil {
+		return nil
+	}
+	if err := store.flush(ctx); err != nil {
+		return err
+	}
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	err := wb.deferredErr
+	wb.deferredErr = nil
+	return err
+}
+
+//读之前写入缓冲，让读能看到缓冲中的写入。写入失败不影响这次读，错误留给之后的Flush返回
+func (store *MongodbStore[T]) flushBeforeRead(ctx context.Context) {
+	err := store.flush(ctx)
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) {
+		//其他错误时全部写入都放回了缓冲，之后的Flush会重试并返回错误
+		return
+	}
+	wb := store.writeBuffer
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	if wb.deferredErr == nil {
+		wb.deferredErr = err
+	}
+}
+
+func (store *MongodbStore[T]) flush(ctx context.Context) error {
+	wb := store.writeBuffer
+	if wb == nil {
+		return nil
+	}
+	wb.flushMutex.Lock()
+	defer wb.flushMutex.Unlock()
+	wb.mutex.Lock()
+	models := wb.pending
+	wb.pending = nil
+	wb.mutex.Unlock()
+	if len(models) == 0 {
+		return nil
+	}
+	_, err := store.collection().BulkWrite(ctx, models, options.BulkWrite().SetBypassDocumentValidation(store.bypassValidation))
+	if err != nil {
+		wb.requeue(unwritten(models, err))
+	}
+	return err
+}
+
+//有序的BulkWrite在第一个失败的写入处停止，之后的写入没有执行。失败的那个随错误返回，不再重试
+func unwritten(models []mongo.WriteModel, err error) []mongo.WriteModel {
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) {
+		if len(bwe.WriteErrors) == 0 {
+			//只有写关注错误，写入都已执行
+			return nil
+		}
+		return models[bwe.WriteErrors[0].Index+1:]
+	}
+	//网络错误等无法知道写到了哪里，全部放回，已经写入的插入重试时会报重复键错误
+	return models
+}
+
+//放回缓冲的最前面，保持写入顺序
+func (wb *writeBuffer) requeue(models []mongo.WriteModel) {
+	if len(models) == 0 {
+		return
+	}
+	wb.mutex.Lock()
+	defer wb.mutex.Unlock()
+	wb.pending = append(append(make([]mongo.WriteModel, 0, len(models)+len(wb.pending)), models...), wb.pending...)
+}
+
+//写入剩余的缓冲
+func (store *MongodbStore[T]) Close(ctx context.Context) error {
+	return store.Flush(ctx)
+}
+
+//开启写缓冲，见MongodbStore.EnableWriteBuffer
+func (repo *MongodbRepository[T]) EnableWriteBuffer(maxPending int) {
+	if repo.store == nil {
+		return
+	}
+	repo.store.EnableWriteBuffer(maxPending)
+}
+
+func (repo *MongodbRepository[T]) Flush(ctx context.Context) error {
+	if repo.store == nil {
+		return nil
+	}
+	return repo.store.Flush(ctx)
+}
+
+func (repo *MongodbRepository[T]) Close(ctx context.Context) error {
+	if repo.store == nil {
+		return nil
+	}
+	return repo.store.Close(ctx)
+}
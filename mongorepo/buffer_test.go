@@ -0,0 +1,88 @@
+package mongorepo_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+	"github.com/framework-arp/ARP4G/arp"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestWriteBufferedInsertIsVisibleToLaterUpdate(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	collection := testCollection(t, client)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, collection, newTestOrder)
+	repo.EnableWriteBuffer(100)
+	err := arp.Go(ctx, func(ctx context.Context) error {
+		order, _ := repo.PutIfAbsent(ctx, "a", &testOrder{"a", "new", 1})
+		order.Qty = 2
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("PutIfAbsent: %v", err)
+	}
+	order, found, err := repo.FindOne(ctx, bson.D{{"_id", "a"}})
+	if err != nil || !found || order.Qty != 2 {
+		t.Fatalf("FindOne: %+v found=%v err=%v, want qty 2", order, found, err)
+	}
+}
+
+func TestWriteBufferReadsSeeConcurrentSaves(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	coll := client.Database(testDatabase).Collection(testCollection(t, client))
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	store.EnableWriteBuffer(1000)
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := store.Save(ctx, id, &testOrder{id, "new", 1}); err != nil {
+				errs <- err
+				return
+			}
+			//另一个goroutine的Flush正在写的时候，这里的Load要等它写完
+			if _, found, err := store.Load(ctx, id); err != nil || !found {
+				errs <- fmt.Errorf("Load %s right after Save: found=%v err=%v", id, found, err)
+			}
+		}(fmt.Sprintf("o%d", i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteBufferReadsDoNotReturnWriteErrors(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	coll := client.Database(testDatabase).Collection(testCollection(t, client))
+	if _, err := coll.InsertOne(ctx, &testOrder{"a", "new", 1}); err != nil {
+		t.Fatalf("InsertOne: %v", err)
+	}
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	store.EnableWriteBuffer(100)
+	store.Save(ctx, "a", &testOrder{"a", "new", 2})
+	store.Save(ctx, "b", &testOrder{"b", "new", 1})
+	//缓冲中a的插入会因为重复键失败，但这是Save a的错误，不应该由读c返回
+	if _, _, err := store.Load(ctx, "c"); err != nil {
+		t.Fatalf("Load returned a buffered write error: %v", err)
+	}
+	if err := store.Flush(ctx); err == nil {
+		t.Fatalf("Flush should return the failed buffered insert")
+	}
+	if err := store.Flush(ctx); err != nil {
+		t.Fatalf("the failed write is reported once: %v", err)
+	}
+	if _, found, err := store.Load(ctx, "b"); err != nil || !found {
+		t.Fatalf("b after Flush: found=%v err=%v", found, err)
+	}
+}
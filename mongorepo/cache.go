@@ -0,0 +1,273 @@
+package mongorepo
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+//实体缓存。缓存的是编码后的文档，每次读取都解码出一个新的实体，保证Load返回的是副本
+type EntityCache interface {
+	Get(id any) (doc bson.Raw, ok bool)
+	Set(id any, doc bson.Raw)
+	Delete(id any)
+}
+
+//带读缓存的store：Load先读缓存，没有再读被包装的store并放入缓存；Save、SaveAll、RemoveAll会让相关id的缓存失效。
+//缓存只在本进程内失效，其他实例的修改要等缓存过期才能看到。为了不在上锁之后读到旧数据而覆盖其他实例的修改，
+//仓库的互斥锁必须用Mutexes包装，这样持有锁的id（Take的加载）总是读库，不走缓存。
+//注意绕过这个store直接写库（例如MongodbRepository上的IncrementField、SaveIf等）不会让缓存失效
+type CachedStore[T any] struct {
+	store         arp.Store[T]
+	cache         EntityCache
+	newZeroEntity arp.NewZeroEntity[T]
+
+	mutex      sync.Mutex
+	generation uint64
+	//本进程持有锁的id为true；锁不存在、Take接下来要加载实体再补锁的id为false
+	locked map[string]bool
+}
+
+func NewCachedStore[T any](store arp.Store[T], cache EntityCache, newZeroEntity arp.NewZeroEntity[T]) *CachedStore[T] {
+	return &CachedStore[T]{store: store, cache: cache, newZeroEntity: newZeroEntity, locked: make(map[string]bool)}
+}
+
+func (cs *CachedStore[T]) Load(ctx context.Context, id any) (entity T, found bool, err error) {
+	key, keyErr := idKey(id)
+	if keyErr != nil {
+		return cs.store.Load(ctx, id)
+	}
+	if held, marked := cs.lockMark(key); marked {
+		//持有锁的加载必须读库，读到的也不放入缓存
+		entity, found, err = cs.store.Load(ctx, id)
+		if !held && (err != nil || !found) {
+			//锁不存在时的加载没有读到实体，Take不会再补锁，去掉标记
+			cs.setAbsent(id, false)
+		}
+		return entity, found, err
+	}
+	if doc, ok := cs.cache.Get(id); ok {
+		entity = cs.newZeroEntity()
+		if err = bson.Unmarshal(doc, entity); err == nil {
+			return entity, true, nil
+		}
+		cs.cache.Delete(id)
+	}
+	generation := cs.currentGeneration()
+	entity, found, err = cs.store.Load(ctx, id)
+	if err != nil || !found {
+		return entity, found, err
+	}
+	if doc, err := bson.Marshal(entity); err == nil {
+		cs.fill(id, doc, generation)
+	}
+	return entity, true, nil
+}
+
+func (cs *CachedStore[T]) currentGeneration() uint64 {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return cs.generation
+}
+
+//读库期间发生过失效就不放入缓存，避免把失效之前读到的旧文档放回去
+func (cs *CachedStore[T]) fill(id any, doc bson.Raw, generation uint64) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if cs.generation == generation {
+		cs.cache.Set(id, doc)
+	}
+}
+
+func (cs *CachedStore[T]) invalidate(ids ...any) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.generation++
+	for _, id := range ids {
+		cs.cache.Delete(id)
+	}
+}
+
+func (cs *CachedStore[T]) Save(ctx context.Context, id any, entity T) error {
+	defer cs.invalidate(id)
+	return cs.store.Save(ctx, id, entity)
+}
+
+func (cs *CachedStore[T]) SaveAll(ctx context.Context, entitiesToInsert map[any]any, entitiesToUpdate map[any]*arp.ProcessEntity) error {
+	defer func() {
+		ids := make([]any, 0, len(entitiesToInsert)+len(entitiesToUpdate))
+		for id := range entitiesToInsert {
+			ids = append(ids, id)
+		}
+		for id := range entitiesToUpdate {
+			ids = append(ids, id)
+		}
+		cs.invalidate(ids...)
+	}()
+	return cs.store.SaveAll(ctx, entitiesToInsert, entitiesToUpdate)
+}
+
+func (cs *CachedStore[T]) RemoveAll(ctx context.Context, ids []any) error {
+	defer cs.invalidate(ids...)
+	return cs.store.RemoveAll(ctx, ids)
+}
+
+func (cs *CachedStore[T]) lockMark(key string) (held bool, marked bool) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	held, marked = cs.locked[key]
+	return held, marked
+}
+
+func (cs *CachedStore[T]) setLocked(id any, locked bool) {
+	key, err := idKey(id)
+	if err != nil {
+		return
+	}
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if locked {
+		cs.locked[key] = true
+		return
+	}
+	delete(cs.locked, key)
+}
+
+//标记或去掉锁不存在时的标记，都不影响持有锁的标记
+func (cs *CachedStore[T]) setAbsent(id any, absent bool) {
+	key, err := idKey(id)
+	if err != nil {
+		return
+	}
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if cs.locked[key] {
+		return
+	}
+	if absent {
+		cs.locked[key] = false
+		return
+	}
+	delete(cs.locked, key)
+}
+
+//包装仓库的互斥锁，让本进程持有锁期间对该id的Load绕过缓存
+func (cs *CachedStore[T]) Mutexes(mutexes arp.Mutexes) arp.Mutexes {
+	return &cacheBypassMutexes{mutexes, cs.setLocked, cs.setAbsent}
+}
+
+type cacheBypassMutexes struct {
+	arp.Mutexes
+	setLocked func(id any, locked bool)
+	setAbsent func(id any, absent bool)
+}
+
+func (mutexes *cacheBypassMutexes) Lock(ctx context.Context, id any) (ok bool, absent bool, err error) {
+	ok, absent, err = mutexes.Mutexes.Lock(ctx, id)
+	if err != nil {
+		return ok, absent, err
+	}
+	if ok {
+		mutexes.setLocked(id, true)
+	} else if absent {
+		//锁不存在时Take会先加载实体再补锁，这次加载也要读库。没有读到实体或者补锁失败时去掉标记
+		mutexes.setAbsent(id, true)
+	}
+	return ok, absent, err
+}
+
+func (mutexes *cacheBypassMutexes) NewAndLock(ctx context.Context, id any) (ok bool, err error) {
+	ok, err = mutexes.Mutexes.NewAndLock(ctx, id)
+	if err == nil && ok {
+		mutexes.setLocked(id, true)
+	} else {
+		mutexes.setAbsent(id, false)
+	}
+	return ok, err
+}
+
+func (mutexes *cacheBypassMutexes) UnlockAll(ctx context.Context, ids []any) {
+	mutexes.Mutexes.UnlockAll(ctx, ids)
+	for _, id := range ids {
+		mutexes.setLocked(id, false)
+	}
+}
+
+//内置的LRU缓存，最多缓存size个实体，每个实体缓存ttl时间，ttl为0表示不过期
+type LRUCache struct {
+	mutex   sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type lruEntry struct {
+	key      string
+	doc      bson.Raw
+	expireAt time.Time
+}
+
+func NewLRUCache(size int, ttl time.Duration) *LRUCache {
+	return &LRUCache{size: size, ttl: ttl, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *LRUCache) Get(id any) (doc bson.Raw, ok bool) {
+	key, err := idKey(id)
+	if err != nil {
+		return nil, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*lruEntry)
+	if c.ttl > 0 && time.Now().After(entry.expireAt) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.doc, true
+}
+
+func (c *LRUCache) Set(id any, doc bson.Raw) {
+	key, err := idKey(id)
+	if err != nil || c.size <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry := &lruEntry{key, doc, time.Now().Add(c.ttl)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *LRUCache) Delete(id any) {
+	key, err := idKey(id)
+	if err != nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,212 @@
+package mongorepo_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+	"github.com/framework-arp/ARP4G/arp"
+)
+
+//记录Load次数的store，onLoad在读到数据之后、返回之前调用
+type countingStore struct {
+	arp.Store[*testOrder]
+	loads  int
+	onLoad func()
+}
+
+func (store *countingStore) Load(ctx context.Context, id any) (*testOrder, bool, error) {
+	store.loads++
+	entity, found, err := store.Store.Load(ctx, id)
+	if store.onLoad != nil {
+		store.onLoad()
+	}
+	return entity, found, err
+}
+
+func newCountingCachedStore(t *testing.T) (*countingStore, *mongorepo.CachedStore[*testOrder]) {
+	t.Helper()
+	counting := &countingStore{Store: mongorepo.NewMemoryStore(newTestOrder)}
+	if err := counting.Save(context.Background(), "a", &testOrder{"a", "new", 1}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	return counting, mongorepo.NewCachedStore[*testOrder](counting, mongorepo.NewLRUCache(10, 0), newTestOrder)
+}
+
+func TestCachedStoreHitAvoidsLoad(t *testing.T) {
+	ctx := context.Background()
+	counting, cs := newCountingCachedStore(t)
+	first, _, _ := cs.Load(ctx, "a")
+	first.Qty = 100
+	second, found, err := cs.Load(ctx, "a")
+	if err != nil || !found {
+		t.Fatalf("Load: found=%v err=%v", found, err)
+	}
+	if counting.loads != 1 {
+		t.Fatalf("underlying loads = %d, want 1", counting.loads)
+	}
+	if second.Qty != 1 {
+		t.Fatalf("cached entity was modified through a loaded copy: qty %d", second.Qty)
+	}
+}
+
+func TestCachedStoreSaveInvalidates(t *testing.T) {
+	ctx := context.Background()
+	counting, cs := newCountingCachedStore(t)
+	cs.Load(ctx, "a")
+	//绕过缓存删除，缓存里还是旧的
+	counting.RemoveAll(ctx, []any{"a"})
+	if _, found, _ := cs.Load(ctx, "a"); !found {
+		t.Fatalf("expected the stale cached entry before invalidation")
+	}
+	if err := cs.Save(ctx, "a", &testOrder{"a", "paid", 2}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	order, _, _ := cs.Load(ctx, "a")
+	if order.Qty != 2 || counting.loads != 2 {
+		t.Fatalf("after Save: qty %d loads %d, want qty 2 loads 2", order.Qty, counting.loads)
+	}
+}
+
+func TestCachedStoreLockedLoadBypassesCache(t *testing.T) {
+	ctx := context.Background()
+	counting, cs := newCountingCachedStore(t)
+	mutexes := cs.Mutexes(arp.NewMockMutexes())
+	cs.Load(ctx, "a")
+	mutexes.Lock(ctx, "a")
+	cs.Load(ctx, "a")
+	cs.Load(ctx, "a")
+	if counting.loads != 3 {
+		t.Fatalf("loads while locked = %d, want 3", counting.loads)
+	}
+	mutexes.UnlockAll(ctx, []any{"a"})
+	cs.Load(ctx, "a")
+	if counting.loads != 3 {
+		t.Fatalf("loads after unlock = %d, want a cache hit", counting.loads)
+	}
+}
+
+//锁记录不存在时Lock返回absent，NewAndLock补锁，refuseNew为true时模拟被别人抢先补锁
+type absentMutexes struct {
+	created   map[any]bool
+	refuseNew bool
+}
+
+func (mutexes *absentMutexes) Lock(ctx context.Context, id any) (ok bool, absent bool, err error) {
+	if !mutexes.created[id] {
+		return false, true, nil
+	}
+	return true, false, nil
+}
+
+func (mutexes *absentMutexes) NewAndLock(ctx context.Context, id any) (ok bool, err error) {
+	if mutexes.refuseNew {
+		return false, nil
+	}
+	mutexes.created[id] = true
+	return true, nil
+}
+
+func (mutexes *absentMutexes) UnlockAll(ctx context.Context, ids []any) {
+}
+
+func TestCachedStoreAbsentLockOnMissingEntityIsCleared(t *testing.T) {
+	ctx := context.Background()
+	counting, cs := newCountingCachedStore(t)
+	mutexes := cs.Mutexes(&absentMutexes{created: map[any]bool{}})
+	//和Take一样：锁不存在时先读库，没有读到实体就不补锁
+	if _, absent, _ := mutexes.Lock(ctx, "b"); !absent {
+		t.Fatalf("Lock b: want absent")
+	}
+	if _, found, _ := cs.Load(ctx, "b"); found {
+		t.Fatalf("Load b: want not found")
+	}
+	counting.Save(ctx, "b", &testOrder{"b", "new", 1})
+	cs.Load(ctx, "b")
+	cs.Load(ctx, "b")
+	if counting.loads != 2 {
+		t.Fatalf("loads = %d, want b cached after the absent load", counting.loads)
+	}
+}
+
+func TestCachedStoreAbsentLockClearedWhenNewAndLockFails(t *testing.T) {
+	ctx := context.Background()
+	counting, cs := newCountingCachedStore(t)
+	mutexes := cs.Mutexes(&absentMutexes{created: map[any]bool{}, refuseNew: true})
+	mutexes.Lock(ctx, "a")
+	cs.Load(ctx, "a")
+	if ok, _ := mutexes.NewAndLock(ctx, "a"); ok {
+		t.Fatalf("NewAndLock a: want refused")
+	}
+	cs.Load(ctx, "a")
+	cs.Load(ctx, "a")
+	if counting.loads != 2 {
+		t.Fatalf("loads = %d, want a cached after the failed NewAndLock", counting.loads)
+	}
+}
+
+func TestCachedStoreAbsentLockBypassesCacheUntilLocked(t *testing.T) {
+	ctx := context.Background()
+	counting, cs := newCountingCachedStore(t)
+	mutexes := cs.Mutexes(&absentMutexes{created: map[any]bool{}})
+	cs.Load(ctx, "a")
+	mutexes.Lock(ctx, "a")
+	cs.Load(ctx, "a")
+	mutexes.NewAndLock(ctx, "a")
+	cs.Load(ctx, "a")
+	if counting.loads != 3 {
+		t.Fatalf("loads = %d, want the absent and locked loads to read the store", counting.loads)
+	}
+	mutexes.UnlockAll(ctx, []any{"a"})
+	cs.Load(ctx, "a")
+	if counting.loads != 3 {
+		t.Fatalf("loads after unlock = %d, want a cache hit", counting.loads)
+	}
+}
+
+func TestCachedStoreDoesNotCacheLoadRacingInvalidation(t *testing.T) {
+	ctx := context.Background()
+	counting, cs := newCountingCachedStore(t)
+	counting.onLoad = func() {
+		counting.onLoad = nil
+		cs.RemoveAll(ctx, []any{"other"})
+	}
+	cs.Load(ctx, "a")
+	cs.Load(ctx, "a")
+	if counting.loads != 2 {
+		t.Fatalf("loads = %d, want the racing load not to be cached", counting.loads)
+	}
+}
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := mongorepo.NewLRUCache(2, 0)
+	cache.Set("a", []byte("a"))
+	cache.Set("b", []byte("b"))
+	cache.Get("a")
+	cache.Set("c", []byte("c"))
+	if _, ok := cache.Get("b"); ok {
+		t.Fatalf("b should have been evicted")
+	}
+	for _, id := range []string{"a", "c"} {
+		if _, ok := cache.Get(id); !ok {
+			t.Fatalf("%s should still be cached", id)
+		}
+	}
+	cache.Delete("a")
+	if _, ok := cache.Get("a"); ok {
+		t.Fatalf("a should have been deleted")
+	}
+}
+
+func TestLRUCacheTTL(t *testing.T) {
+	cache := mongorepo.NewLRUCache(10, 10*time.Millisecond)
+	cache.Set("a", []byte("a"))
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatalf("a should be cached")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := cache.Get("a"); ok {
+		t.Fatalf("a should have expired")
+	}
+}
@@ -0,0 +1,28 @@
+package mongorepo
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type collationCtxKey struct{}
+
+//返回带有collation的ctx，使用这个ctx的查询方法（QueryAllByField、QueryTopN、QueryAfter、FindOne等）都会使用这个collation，
+//例如options.Collation{Locale: "en", Strength: 2}可以做大小写不敏感的匹配和排序
+func WithCollation(ctx context.Context, collation *options.Collation) context.Context {
+	return context.WithValue(ctx, collationCtxKey{}, collation)
+}
+
+func collationFrom(ctx context.Context) *options.Collation {
+	collation, _ := ctx.Value(collationCtxKey{}).(*options.Collation)
+	return collation
+}
+
+func findOptions(ctx context.Context) *options.FindOptions {
+	opts := options.Find()
+	if collation := collationFrom(ctx); collation != nil {
+		opts.SetCollation(collation)
+	}
+	return opts
+}
@@ -0,0 +1,44 @@
+package mongorepo_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestWithCollationOrdering(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, testCollection(t, client), newTestOrder)
+	for _, status := range []string{"b", "C", "A"} {
+		repo.InsertIfAbsent(ctx, status, &testOrder{status, status, 1})
+	}
+	statuses := func(ctx context.Context) []string {
+		orders, err := repo.QueryTopN(ctx, "qty", 1, "status", true, 3)
+		if err != nil {
+			t.Fatalf("QueryTopN: %v", err)
+		}
+		result := make([]string, 0, len(orders))
+		for _, order := range orders {
+			result = append(result, order.Status)
+		}
+		return result
+	}
+	//默认按字节序，大写字母排在小写字母前面
+	if got := statuses(ctx); !reflect.DeepEqual(got, []string{"A", "C", "b"}) {
+		t.Fatalf("default ordering = %v, want [A C b]", got)
+	}
+	collated := mongorepo.WithCollation(ctx, &options.Collation{Locale: "en", Strength: 2})
+	if got := statuses(collated); !reflect.DeepEqual(got, []string{"A", "b", "C"}) {
+		t.Fatalf("collated ordering = %v, want [A b C]", got)
+	}
+	//strength为2时匹配也不区分大小写
+	orders, err := repo.QueryAllByField(collated, "status", "a")
+	if err != nil || len(orders) != 1 || orders[0].Id != "A" {
+		t.Fatalf("collated QueryAllByField = %v err=%v, want the order A", orders, err)
+	}
+}
@@ -0,0 +1,117 @@
+package mongorepo
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//只在id不存在时插入，已存在时不写并返回inserted为false
+func (store *MongodbStore[T]) InsertIfAbsent(ctx context.Context, id any, entity T) (inserted bool, err error) {
+	if err = store.checkDocumentSize(id, entity); err != nil {
+		return false, err
+	}
+	filter, err := store.idFilter(id)
+	if err != nil {
+		return false, err
+	}
+	actor, err := store.auditActor(ctx)
+	if err != nil {
+		return false, err
+	}
+	doc, err := store.toDocument(ctx, entity)
+	if err != nil {
+		return false, err
+	}
+	newRef := store.gridFS.ref(doc)
+	if doc, err = store.stampInsert(doc, actor); err != nil {
+		store.deleteGridFSFile(ctx, newRef)
+		return false, err
+	}
+	update := bson.D{{"$setOnInsert", doc}}
+	ur, err := store.collection().UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil || ur.UpsertedCount == 0 {
+		store.deleteGridFSFile(ctx, newRef)
+		return false, err
+	}
+	return ur.UpsertedCount > 0, nil
+}
+
+//只在id存在时替换，不存在时不写并返回updated为false
+func (store *MongodbStore[T]) UpdateIfPresent(ctx context.Context, id any, entity T) (updated bool, err error) {
+	if err = store.checkDocumentSize(id, entity); err != nil {
+		return false, err
+	}
+	filter, err := store.idFilter(id)
+	if err != nil {
+		return false, err
+	}
+	actor, err := store.auditActor(ctx)
+	if err != nil {
+		return false, err
+	}
+	return store.replaceDocument(ctx, filter, entity, actor)
+}
+
+func (repo *MongodbRepository[T]) InsertIfAbsent(ctx context.Context, id any, entity T) (inserted bool, err error) {
+	if repo.store == nil {
+		return false, nil
+	}
+	return repo.store.InsertIfAbsent(ctx, id, entity)
+}
+
+func (repo *MongodbRepository[T]) UpdateIfPresent(ctx context.Context, id any, entity T) (updated bool, err error) {
+	if repo.store == nil {
+		return false, nil
+	}
+	return repo.store.UpdateIfPresent(ctx, id, entity)
+}
+
+//只在库里的文档满足condition时替换（比较并交换），例如只在status仍然是pending时保存：
+//store.SaveIf(ctx, id, order, bson.D{{"status", "pending"}})
+//条件不满足或者id不存在时返回swapped为false
+func (store *MongodbStore[T]) SaveIf(ctx context.Context, id any, entity T, condition bson.D) (swapped bool, err error) {
+	if err = store.checkBeforeWrite(id, entity); err != nil {
+		return false, err
+	}
+	filter, err := store.idFilter(id)
+	if err != nil {
+		return false, err
+	}
+	filter = append(filter, condition...)
+	actor, err := store.auditActor(ctx)
+	if err != nil {
+		return false, err
+	}
+	return store.replaceDocument(ctx, filter, entity, actor)
+}
+
+func (repo *MongodbRepository[T]) SaveIf(ctx context.Context, id any, entity T, condition bson.D) (swapped bool, err error) {
+	if repo.store == nil {
+		return false, nil
+	}
+	return repo.store.SaveIf(ctx, id, entity, condition)
+}
+
+//插入实体，id已存在时不覆盖，返回ErrAlreadyExists（和MemoryStore一致），用于必须发现误覆盖的场景
+func (store *MongodbStore[T]) SaveStrict(ctx context.Context, id any, entity T) error {
+	if err := store.checkBeforeWrite(id, entity); err != nil {
+		return err
+	}
+	inserted, err := store.InsertIfAbsent(ctx, id, entity)
+	if err != nil {
+		return err
+	}
+	if !inserted {
+		return ErrAlreadyExists
+	}
+	return nil
+}
+
+func (repo *MongodbRepository[T]) SaveStrict(ctx context.Context, id any, entity T) error {
+	if repo.store == nil {
+		return nil
+	}
+	return repo.store.SaveStrict(ctx, id, entity)
+}
@@ -0,0 +1,104 @@
+package mongorepo_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestInsertIfAbsent(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	coll := client.Database(testDatabase).Collection(testCollection(t, client))
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	inserted, err := store.InsertIfAbsent(ctx, "a", &testOrder{"a", "new", 1})
+	if err != nil || !inserted {
+		t.Fatalf("InsertIfAbsent absent id: inserted=%v err=%v", inserted, err)
+	}
+	//id已存在，不覆盖
+	inserted, err = store.InsertIfAbsent(ctx, "a", &testOrder{"a", "paid", 2})
+	if err != nil || inserted {
+		t.Fatalf("InsertIfAbsent existing id: inserted=%v err=%v", inserted, err)
+	}
+	if order, _, _ := store.Load(ctx, "a"); order.Status != "new" || order.Qty != 1 {
+		t.Fatalf("existing document was overwritten: %+v", order)
+	}
+}
+
+func TestUpdateIfPresent(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	coll := client.Database(testDatabase).Collection(testCollection(t, client))
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	//id不存在，不插入
+	updated, err := store.UpdateIfPresent(ctx, "a", &testOrder{"a", "paid", 2})
+	if err != nil || updated {
+		t.Fatalf("UpdateIfPresent absent id: updated=%v err=%v", updated, err)
+	}
+	if _, found, _ := store.Load(ctx, "a"); found {
+		t.Fatalf("UpdateIfPresent created an absent document")
+	}
+	store.Save(ctx, "a", &testOrder{"a", "new", 1})
+	updated, err = store.UpdateIfPresent(ctx, "a", &testOrder{"a", "paid", 2})
+	if err != nil || !updated {
+		t.Fatalf("UpdateIfPresent existing id: updated=%v err=%v", updated, err)
+	}
+	if order, _, _ := store.Load(ctx, "a"); order.Status != "paid" || order.Qty != 2 {
+		t.Fatalf("existing document not replaced: %+v", order)
+	}
+}
+
+func TestSaveIfConditionMet(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	coll := client.Database(testDatabase).Collection(testCollection(t, client))
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	store.Save(ctx, "a", &testOrder{"a", "pending", 1})
+	swapped, err := store.SaveIf(ctx, "a", &testOrder{"a", "paid", 2}, bson.D{{"status", "pending"}})
+	if err != nil || !swapped {
+		t.Fatalf("SaveIf condition met: swapped=%v err=%v", swapped, err)
+	}
+	if order, _, _ := store.Load(ctx, "a"); order.Status != "paid" || order.Qty != 2 {
+		t.Fatalf("document not replaced: %+v", order)
+	}
+}
+
+func TestSaveIfConditionFailed(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	coll := client.Database(testDatabase).Collection(testCollection(t, client))
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	store.Save(ctx, "a", &testOrder{"a", "shipped", 1})
+	swapped, err := store.SaveIf(ctx, "a", &testOrder{"a", "paid", 2}, bson.D{{"status", "pending"}})
+	if err != nil || swapped {
+		t.Fatalf("SaveIf condition failed: swapped=%v err=%v", swapped, err)
+	}
+	if order, _, _ := store.Load(ctx, "a"); order.Status != "shipped" || order.Qty != 1 {
+		t.Fatalf("document replaced although the condition failed: %+v", order)
+	}
+	//id不存在，不插入
+	swapped, err = store.SaveIf(ctx, "b", &testOrder{"b", "paid", 2}, bson.D{{"status", "pending"}})
+	if err != nil || swapped {
+		t.Fatalf("SaveIf absent id: swapped=%v err=%v", swapped, err)
+	}
+	if _, found, _ := store.Load(ctx, "b"); found {
+		t.Fatalf("SaveIf created an absent document")
+	}
+}
+
+func TestSaveStrict(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, testCollection(t, client), newTestOrder)
+	if err := repo.SaveStrict(ctx, "a", &testOrder{"a", "new", 1}); err != nil {
+		t.Fatalf("SaveStrict new id: %v", err)
+	}
+	err := repo.SaveStrict(ctx, "a", &testOrder{"a", "new", 2})
+	if !errors.Is(err, mongorepo.ErrAlreadyExists) {
+		t.Fatalf("SaveStrict existing id: %v, want ErrAlreadyExists", err)
+	}
+}
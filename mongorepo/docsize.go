@@ -0,0 +1,46 @@
+package mongorepo
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+//MongoDB单个文档的大小上限
+const DefaultMaxDocumentSize = 16 * 1024 * 1024
+
+//文档编码后超过大小上限，Size为编码后的实际大小
+type ErrDocumentTooLarge struct {
+	Id    any
+	Size  int
+	Limit int
+}
+
+func (e *ErrDocumentTooLarge) Error() string {
+	return fmt.Sprintf("document %v is too large: %d bytes exceeds limit of %d bytes", e.Id, e.Size, e.Limit)
+}
+
+//设置写入前检查的文档大小上限，默认为16MB，设置为0则不检查
+func (store *MongodbStore[T]) SetMaxDocumentSize(maxDocSize int) {
+	store.maxDocSize = maxDocSize
+}
+
+func (store *MongodbStore[T]) checkDocumentSize(id any, entity any) error {
+	if store.maxDocSize <= 0 {
+		return nil
+	}
+	doc, err := bson.MarshalWithRegistry(store.registry, entity)
+	if err != nil {
+		return err
+	}
+	if store.gridFS != nil {
+		//存放到GridFS的大字段不计入文档大小
+		if doc, err = store.gridFS.withoutField(doc); err != nil {
+			return err
+		}
+	}
+	if len(doc) > store.maxDocSize {
+		return &ErrDocumentTooLarge{id, len(doc), store.maxDocSize}
+	}
+	return nil
+}
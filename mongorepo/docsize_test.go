@@ -0,0 +1,39 @@
+package mongorepo
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCheckDocumentSize(t *testing.T) {
+	store := NewMongodbStore[*testEntity](nil, newTestEntity)
+	store.SetMaxDocumentSize(100)
+	if err := store.checkDocumentSize("small", &testEntity{Id: "small"}); err != nil {
+		t.Fatalf("small document: %v", err)
+	}
+	err := store.checkDocumentSize("big", &testEntity{Id: "big", Data: make([]byte, 200)})
+	var tooLarge *ErrDocumentTooLarge
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("big document error = %v, want *ErrDocumentTooLarge", err)
+	}
+	if tooLarge.Id != "big" || tooLarge.Size <= 200 || tooLarge.Limit != 100 {
+		t.Fatalf("ErrDocumentTooLarge = %+v", tooLarge)
+	}
+
+	store.SetMaxDocumentSize(0)
+	if err = store.checkDocumentSize("big", &testEntity{Id: "big", Data: make([]byte, 200)}); err != nil {
+		t.Fatalf("size check disabled: %v", err)
+	}
+}
+
+func TestSaveRejectsOversizedDocumentBeforeWriting(t *testing.T) {
+	//没有集合，能返回ErrDocumentTooLarge说明检查发生在写库之前
+	store := NewMongodbStore[*testEntity](nil, newTestEntity)
+	store.SetMaxDocumentSize(100)
+	err := store.Save(context.Background(), "big", &testEntity{Id: "big", Data: make([]byte, 200)})
+	var tooLarge *ErrDocumentTooLarge
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("Save error = %v, want *ErrDocumentTooLarge", err)
+	}
+}
@@ -0,0 +1,27 @@
+package mongorepo
+
+import (
+	"context"
+
+	"github.com/framework-arp/ARP4G/arp"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//使用MongoDB客户端字段级加密(CSFLE)的仓库。用clientOpts和autoEncryptionOpts建立一个开启自动加密的客户端，
+//schema map中配置的字段在写入时自动加密，读取时自动解密，对实体是透明的。
+//前提条件：
+//1. 编译时加上-tags cse，并安装libmongocrypt
+//2. 准备好密钥库(key vault)集合，并在其中创建数据密钥，autoEncryptionOpts中设置KeyVaultNamespace和KmsProviders
+//3. 在autoEncryptionOpts的SchemaMap中为database.collection配置需要加密的字段
+//4. 自动加密需要mongocryptd或crypt_shared库可用（企业版或Atlas）
+//返回的客户端由调用者负责断开
+func NewMongodbRepositoryWithAutoEncryption[T any](ctx context.Context, clientOpts *options.ClientOptions, autoEncryptionOpts *options.AutoEncryptionOptions,
+	database string, collection string, newZeroEntity arp.NewZeroEntity[T]) (*MongodbRepository[T], *mongo.Client, error) {
+	client, err := mongo.Connect(ctx, options.MergeClientOptions(clientOpts, options.Client().SetAutoEncryptionOptions(autoEncryptionOpts)))
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewMongodbRepository(client, database, collection, newZeroEntity), client, nil
+}
@@ -0,0 +1,83 @@
+package mongorepo_test
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"testing"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//需要用-tags cse编译，并通过MONGODB_CRYPT_SHARED_LIB_PATH指定crypt_shared库，没有设置时跳过测试。
+//使用本地(local)密钥，不依赖外部的KMS
+func TestAutoEncryptionRepository(t *testing.T) {
+	cryptSharedLibPath := os.Getenv("MONGODB_CRYPT_SHARED_LIB_PATH")
+	if cryptSharedLibPath == "" {
+		t.Skip("MONGODB_CRYPT_SHARED_LIB_PATH not set")
+	}
+	ctx := context.Background()
+	client := testClient(t)
+	collection := testCollection(t, client)
+	keyVaultCollection := collection + "_keyvault"
+	t.Cleanup(func() {
+		client.Database(testDatabase).Collection(keyVaultCollection).Drop(context.Background())
+	})
+	keyVaultNamespace := testDatabase + "." + keyVaultCollection
+	localKey := make([]byte, 96)
+	if _, err := rand.Read(localKey); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+	kmsProviders := map[string]map[string]any{"local": {"key": localKey}}
+	clientEncryption, err := mongo.NewClientEncryption(client, options.ClientEncryption().SetKeyVaultNamespace(keyVaultNamespace).SetKmsProviders(kmsProviders))
+	if err != nil {
+		t.Fatalf("NewClientEncryption: %v", err)
+	}
+	defer clientEncryption.Close(ctx)
+	dataKeyId, err := clientEncryption.CreateDataKey(ctx, "local")
+	if err != nil {
+		t.Fatalf("CreateDataKey: %v", err)
+	}
+	//status字段确定性加密
+	schema := bson.D{
+		{"bsonType", "object"},
+		{"encryptMetadata", bson.D{{"keyId", bson.A{dataKeyId}}}},
+		{"properties", bson.D{{"status", bson.D{{"encrypt", bson.D{
+			{"bsonType", "string"},
+			{"algorithm", "AEAD_AES_256_CBC_HMAC_SHA_512-Deterministic"},
+		}}}}}},
+	}
+	autoEncryptionOpts := options.AutoEncryption().
+		SetKeyVaultNamespace(keyVaultNamespace).
+		SetKmsProviders(kmsProviders).
+		SetSchemaMap(map[string]any{testDatabase + "." + collection: schema}).
+		SetExtraOptions(map[string]any{"cryptSharedLibPath": cryptSharedLibPath, "cryptSharedLibRequired": true})
+	clientOpts := options.Client().ApplyURI(os.Getenv("MONGODB_URI"))
+	repo, encryptedClient, err := mongorepo.NewMongodbRepositoryWithAutoEncryption(ctx, clientOpts, autoEncryptionOpts, testDatabase, collection, newTestOrder)
+	if err != nil {
+		t.Fatalf("NewMongodbRepositoryWithAutoEncryption: %v", err)
+	}
+	defer encryptedClient.Disconnect(ctx)
+
+	if inserted, err := repo.InsertIfAbsent(ctx, "o1", &testOrder{"o1", "secret", 1}); err != nil || !inserted {
+		t.Fatalf("InsertIfAbsent: inserted=%v err=%v", inserted, err)
+	}
+	//不带加密的客户端直接读到的是密文
+	raw, err := client.Database(testDatabase).Collection(collection).FindOne(ctx, bson.D{{"_id", "o1"}}).DecodeBytes()
+	if err != nil {
+		t.Fatalf("FindOne: %v", err)
+	}
+	status := raw.Lookup("status")
+	if subtype, _, ok := status.BinaryOK(); status.Type != bsontype.Binary || !ok || subtype != 6 {
+		t.Fatalf("stored status = %v, want encrypted binary", status)
+	}
+	order, _, found, err := repo.LoadRaw(ctx, "o1")
+	if err != nil || !found || order.Status != "secret" {
+		t.Fatalf("LoadRaw = %+v found=%v err=%v, want the decrypted status", order, found, err)
+	}
+}
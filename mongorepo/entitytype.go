@@ -0,0 +1,59 @@
+package mongorepo
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/framework-arp/ARP4G/arp"
+)
+
+//在启动时检查实体类型是否符合约定：newZeroEntity返回非nil的struct指针，第一个属性为可导出的id，且映射到idField。
+//idField为文档中存放id的字段名，为空时按默认的_id检查
+func ValidateEntityType[T any](newZeroEntity arp.NewZeroEntity[T], idField string) error {
+	if idField == "" {
+		idField = defaultIdField
+	}
+	if newZeroEntity == nil {
+		return fmt.Errorf("newZeroEntity is nil")
+	}
+	entity := any(newZeroEntity())
+	v := reflect.ValueOf(entity)
+	if !v.IsValid() {
+		return fmt.Errorf("newZeroEntity returns nil")
+	}
+	if v.Kind() != reflect.Pointer {
+		return fmt.Errorf("newZeroEntity should return a pointer, but returns %s", v.Type())
+	}
+	if v.IsNil() {
+		return fmt.Errorf("newZeroEntity returns a nil %s", v.Type())
+	}
+	st := v.Elem().Type()
+	if st.Kind() != reflect.Struct {
+		return fmt.Errorf("entity should be a struct, but is %s", st)
+	}
+	if st.NumField() == 0 {
+		return fmt.Errorf("entity %s has no field, the first field should be the id", st)
+	}
+	first := st.Field(0)
+	if !first.IsExported() {
+		return fmt.Errorf("the first field %s of entity %s should be exported since it is the id", first.Name, st)
+	}
+	if name, _, _ := strings.Cut(first.Tag.Get("bson"), ","); name != idField {
+		return fmt.Errorf("the first field %s of entity %s should be tagged `bson:\"%s\"`", first.Name, st, idField)
+	}
+	return nil
+}
+
+//按store设置的id字段检查实体类型，见ValidateEntityType
+func (store *MongodbStore[T]) ValidateEntityType() error {
+	return ValidateEntityType(store.newZeroEntity, store.idField)
+}
+
+//按repository设置的id字段检查实体类型，见ValidateEntityType
+func (repo *MongodbRepository[T]) ValidateEntityType() error {
+	if repo.store == nil {
+		return nil
+	}
+	return repo.store.ValidateEntityType()
+}
@@ -0,0 +1,58 @@
+package mongorepo_test
+
+import (
+	"testing"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+)
+
+type orderByNo struct {
+	No     string `bson:"orderNo"`
+	Status string `bson:"status"`
+}
+
+type untaggedOrder struct {
+	Id     string
+	Status string
+}
+
+type unexportedIdOrder struct {
+	id     string `bson:"_id"`
+	Status string `bson:"status"`
+}
+
+func TestValidateEntityTypeWellFormed(t *testing.T) {
+	if err := mongorepo.ValidateEntityType(newTestOrder, ""); err != nil {
+		t.Fatalf("default id field: %v", err)
+	}
+	newOrderByNo := func() *orderByNo { return &orderByNo{} }
+	if err := mongorepo.ValidateEntityType(newOrderByNo, "orderNo"); err != nil {
+		t.Fatalf("custom id field: %v", err)
+	}
+	store := mongorepo.NewMongodbStore(nil, newOrderByNo)
+	store.SetIdField("orderNo")
+	if err := store.ValidateEntityType(); err != nil {
+		t.Fatalf("store id field: %v", err)
+	}
+}
+
+func TestValidateEntityTypeMalformed(t *testing.T) {
+	cases := map[string]error{
+		"nil newZeroEntity":  mongorepo.ValidateEntityType[*testOrder](nil, ""),
+		"returns nil":        mongorepo.ValidateEntityType(func() *testOrder { return nil }, ""),
+		"not a pointer":      mongorepo.ValidateEntityType(func() testOrder { return testOrder{} }, ""),
+		"not a struct":       mongorepo.ValidateEntityType(func() *string { return new(string) }, ""),
+		"untagged id":        mongorepo.ValidateEntityType(func() *untaggedOrder { return &untaggedOrder{} }, ""),
+		"unexported id":      mongorepo.ValidateEntityType(func() *unexportedIdOrder { return &unexportedIdOrder{} }, ""),
+		"different id field": mongorepo.ValidateEntityType(newTestOrder, "orderNo"),
+	}
+	for name, err := range cases {
+		if err == nil {
+			t.Errorf("%s: want an error", name)
+		}
+	}
+	store := mongorepo.NewMongodbStore(nil, func() *orderByNo { return &orderByNo{} })
+	if err := store.ValidateEntityType(); err == nil {
+		t.Errorf("store with default id field: want an error for orderNo")
+	}
+}
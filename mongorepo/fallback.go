@@ -0,0 +1,139 @@
+package mongorepo
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+)
+
+//锁存储不可用时降级为进程内锁的互斥锁实现。primary（通常是MongodbMutexes）出错时，
+//这次上锁改用进程内的锁，并调用onFallback发出告警。进程内的锁只能保证本进程内互斥，多实例部署时降级期间可能有并发修改，
+//所以只适合能接受这个风险、更看重可用性的场景。用法：
+//NewMongodbRepositoryWithMutexesimpl(client, database, collection, newZeroEntity, NewFallbackMutexes(NewMongodbMutexes(client, database, collection), 0, onFallback))
+type FallbackMutexes struct {
+	primary     arp.Mutexes
+	maxLockTime time.Duration
+	onFallback  func(id any, err error)
+	mutex       sync.Mutex
+	held        map[string]heldLock
+}
+
+//本进程持有的锁，包括通过primary拿到的，这样降级时不会把已经被本进程持有的锁再给出去
+type heldLock struct {
+	local    bool
+	expireAt time.Time
+}
+
+//maxLockTime为进程内锁的最长持有时间，超过之后可以被其他人拿到，和MongodbMutexes的最长上锁时间含义相同，为0时使用默认的1分钟。
+//onFallback可以为nil
+func NewFallbackMutexes(primary arp.Mutexes, maxLockTime time.Duration, onFallback func(id any, err error)) *FallbackMutexes {
+	if maxLockTime <= 0 {
+		maxLockTime = defaultMaxLockTime * time.Millisecond
+	}
+	return &FallbackMutexes{primary: primary, maxLockTime: maxLockTime, onFallback: onFallback, held: make(map[string]heldLock)}
+}
+
+func (mutexes *FallbackMutexes) Lock(ctx context.Context, id any) (ok bool, absent bool, err error) {
+	if mutexes.heldLocally(id) {
+		return false, false, nil
+	}
+	ok, absent, err = mutexes.primary.Lock(ctx, id)
+	if !mutexes.shouldFallback(ctx, err) {
+		if err == nil && ok {
+			mutexes.hold(id, false)
+		}
+		return ok, absent, err
+	}
+	ok, err = mutexes.lockLocal(id, err)
+	return ok, false, err
+}
+
+func (mutexes *FallbackMutexes) NewAndLock(ctx context.Context, id any) (ok bool, err error) {
+	if mutexes.heldLocally(id) {
+		return false, nil
+	}
+	ok, err = mutexes.primary.NewAndLock(ctx, id)
+	if !mutexes.shouldFallback(ctx, err) {
+		if err == nil && ok {
+			mutexes.hold(id, false)
+		}
+		return ok, err
+	}
+	return mutexes.lockLocal(id, err)
+}
+
+//降级期间拿到的进程内锁在这里释放，其余的交给primary
+func (mutexes *FallbackMutexes) UnlockAll(ctx context.Context, ids []any) {
+	primaryIds := make([]any, 0, len(ids))
+	mutexes.mutex.Lock()
+	for _, id := range ids {
+		key, err := idKey(id)
+		if err != nil {
+			primaryIds = append(primaryIds, id)
+			continue
+		}
+		held, ok := mutexes.held[key]
+		delete(mutexes.held, key)
+		if ok && held.local {
+			continue
+		}
+		primaryIds = append(primaryIds, id)
+	}
+	mutexes.mutex.Unlock()
+	if len(primaryIds) > 0 {
+		mutexes.primary.UnlockAll(ctx, primaryIds)
+	}
+}
+
+//降级期间拿到、还没有过期的进程内锁。锁存储恢复之后primary并不知道这些锁，要先在这里拦住，
+//否则primary会把同一个id再给出去，释放时也会分不清是谁的锁
+func (mutexes *FallbackMutexes) heldLocally(id any) bool {
+	key, err := idKey(id)
+	if err != nil {
+		return false
+	}
+	mutexes.mutex.Lock()
+	defer mutexes.mutex.Unlock()
+	held, ok := mutexes.held[key]
+	return ok && held.local && time.Now().Before(held.expireAt)
+}
+
+func (mutexes *FallbackMutexes) hold(id any, local bool) {
+	key, err := idKey(id)
+	if err != nil {
+		return
+	}
+	mutexes.mutex.Lock()
+	defer mutexes.mutex.Unlock()
+	mutexes.held[key] = heldLock{local, time.Now().Add(mutexes.maxLockTime)}
+}
+
+//ctx被取消或者只是重试次数用完，不是锁存储的故障，不降级
+func (mutexes *FallbackMutexes) shouldFallback(ctx context.Context, err error) bool {
+	return err != nil && err != ErrLockTimeout && ctx.Err() == nil
+}
+
+func (mutexes *FallbackMutexes) lockLocal(id any, cause error) (ok bool, err error) {
+	key, err := idKey(id)
+	if err != nil {
+		return false, err
+	}
+	if mutexes.onFallback != nil {
+		mutexes.onFallback(id, cause)
+	}
+	mutexes.mutex.Lock()
+	defer mutexes.mutex.Unlock()
+	now := time.Now()
+	for k, held := range mutexes.held {
+		if !now.Before(held.expireAt) {
+			delete(mutexes.held, k)
+		}
+	}
+	if _, ok := mutexes.held[key]; ok {
+		return false, nil
+	}
+	mutexes.held[key] = heldLock{true, now.Add(mutexes.maxLockTime)}
+	return true, nil
+}
@@ -0,0 +1,123 @@
+package mongorepo_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+	"github.com/framework-arp/ARP4G/arp"
+)
+
+//可以切换成故障状态的锁
+type flakyMutexes struct {
+	down     bool
+	unlocked []any
+}
+
+var errLockStoreDown = errors.New("lock store down")
+
+func (m *flakyMutexes) Lock(ctx context.Context, id any) (bool, bool, error) {
+	if m.down {
+		return false, false, errLockStoreDown
+	}
+	return true, false, nil
+}
+
+func (m *flakyMutexes) NewAndLock(ctx context.Context, id any) (bool, error) {
+	if m.down {
+		return false, errLockStoreDown
+	}
+	return true, nil
+}
+
+func (m *flakyMutexes) UnlockAll(ctx context.Context, ids []any) {
+	m.unlocked = append(m.unlocked, ids...)
+}
+
+func TestFallbackMutexesReadsSucceedWhenLockStoreIsDown(t *testing.T) {
+	ctx := context.Background()
+	store := mongorepo.NewMemoryStore(newTestOrder)
+	store.Save(ctx, "a", &testOrder{"a", "new", 1})
+	primary := &flakyMutexes{down: true}
+	warnings := 0
+	mutexes := mongorepo.NewFallbackMutexes(primary, 0, func(id any, err error) { warnings++ })
+	repo := arp.NewRepository[*testOrder](store, mutexes, newTestOrder)
+	err := arp.Go(ctx, func(ctx context.Context) error {
+		order, found := repo.Take(ctx, "a")
+		if !found || order.Qty != 1 {
+			t.Errorf("Take: %+v found=%v", order, found)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Take with the lock store down: %v", err)
+	}
+	if warnings == 0 {
+		t.Fatalf("expected a fallback warning")
+	}
+}
+
+func TestFallbackMutexesKnowsLocksHeldThroughPrimary(t *testing.T) {
+	ctx := context.Background()
+	primary := &flakyMutexes{}
+	mutexes := mongorepo.NewFallbackMutexes(primary, 0, nil)
+	if ok, _, err := mutexes.Lock(ctx, "x"); err != nil || !ok {
+		t.Fatalf("Lock through primary: ok=%v err=%v", ok, err)
+	}
+	primary.down = true
+	if ok, _, err := mutexes.Lock(ctx, "x"); err != nil || ok {
+		t.Fatalf("second holder in the same process: ok=%v err=%v", ok, err)
+	}
+	mutexes.UnlockAll(ctx, []any{"x"})
+	if len(primary.unlocked) != 1 {
+		t.Fatalf("lock held through primary should be released by primary, got %v", primary.unlocked)
+	}
+	if ok, _, err := mutexes.Lock(ctx, "x"); err != nil || !ok {
+		t.Fatalf("Lock after unlock: ok=%v err=%v", ok, err)
+	}
+}
+
+func TestFallbackMutexesLocalLocksExpire(t *testing.T) {
+	ctx := context.Background()
+	mutexes := mongorepo.NewFallbackMutexes(&flakyMutexes{down: true}, 10*time.Millisecond, nil)
+	if ok, _, _ := mutexes.Lock(ctx, "x"); !ok {
+		t.Fatalf("first local Lock failed")
+	}
+	if ok, _, _ := mutexes.Lock(ctx, "x"); ok {
+		t.Fatalf("local lock should be held")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if ok, _, _ := mutexes.Lock(ctx, "x"); !ok {
+		t.Fatalf("expired local lock should be acquirable")
+	}
+}
+
+func TestFallbackMutexesLocalLockSurvivesRecovery(t *testing.T) {
+	ctx := context.Background()
+	primary := &flakyMutexes{down: true}
+	mutexes := mongorepo.NewFallbackMutexes(primary, 0, nil)
+	if ok, _, err := mutexes.Lock(ctx, "x"); err != nil || !ok {
+		t.Fatalf("local Lock during outage: ok=%v err=%v", ok, err)
+	}
+	primary.down = false
+	if ok, _, err := mutexes.Lock(ctx, "x"); err != nil || ok {
+		t.Fatalf("Lock after recovery while held locally: ok=%v err=%v", ok, err)
+	}
+	if ok, err := mutexes.NewAndLock(ctx, "x"); err != nil || ok {
+		t.Fatalf("NewAndLock after recovery while held locally: ok=%v err=%v", ok, err)
+	}
+	//释放本地锁不会去释放primary上的锁
+	mutexes.UnlockAll(ctx, []any{"x"})
+	if len(primary.unlocked) != 0 {
+		t.Fatalf("local lock released through primary: %v", primary.unlocked)
+	}
+	if ok, _, err := mutexes.Lock(ctx, "x"); err != nil || !ok {
+		t.Fatalf("Lock after the local holder unlocked: ok=%v err=%v", ok, err)
+	}
+	mutexes.UnlockAll(ctx, []any{"x"})
+	if len(primary.unlocked) != 1 {
+		t.Fatalf("lock taken through primary should be released by primary, got %v", primary.unlocked)
+	}
+}
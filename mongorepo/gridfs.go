@@ -0,0 +1,267 @@
+package mongorepo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//存放到GridFS的大字段。写入时字段的二进制内容上传到GridFS，文档中该字段只保存GridFS文件的id，
+//加载时再从GridFS下载回来，对实体是透明的。实体更新或删除时，旧的GridFS文件会被删除。
+//更新时内容没有变化（按文件metadata中记录的sha256比较）就继续引用原来的文件，不重新上传
+type gridFSField struct {
+	bucket *gridfs.Bucket
+	field  string
+}
+
+//返回文档中field字段引用的GridFS文件id，没有则返回nil
+func (g *gridFSField) ref(doc any) *primitive.ObjectID {
+	if g == nil {
+		return nil
+	}
+	d, ok := doc.(bson.D)
+	if !ok {
+		return nil
+	}
+	for _, e := range d {
+		if e.Key == g.field {
+			if fileId, ok := e.Value.(primitive.ObjectID); ok {
+				return &fileId
+			}
+		}
+	}
+	return nil
+}
+
+//去掉field字段之后的文档
+func (g *gridFSField) withoutField(raw bson.Raw) (bson.Raw, error) {
+	var d bson.D
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		return nil, err
+	}
+	for i, e := range d {
+		if e.Key == g.field {
+			d = append(d[:i], d[i+1:]...)
+			break
+		}
+	}
+	return bson.Marshal(d)
+}
+
+//上传时记录在GridFS文件metadata中的内容摘要
+const gridFSHashField = "sha256"
+
+//把实体转换成要写入的文档，开启GridFS时会把大字段上传到GridFS，并替换为文件id
+func (store *MongodbStore[T]) toDocument(ctx context.Context, entity any) (any, error) {
+	return store.toDocumentReusing(ctx, entity, nil)
+}
+
+//previous为库里文档当前引用的GridFS文件，内容相同时直接引用它
+func (store *MongodbStore[T]) toDocumentReusing(ctx context.Context, entity any, previous *primitive.ObjectID) (any, error) {
+	if store.gridFS == nil {
+		return entity, nil
+	}
+	raw, err := bson.MarshalWithRegistry(store.registry, entity)
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err = bson.Unmarshal(raw, &d); err != nil {
+		return nil, err
+	}
+	for i, e := range d {
+		if e.Key != store.gridFS.field {
+			continue
+		}
+		bin, ok := e.Value.(primitive.Binary)
+		if !ok {
+			break
+		}
+		sum := sha256.Sum256(bin.Data)
+		hash := hex.EncodeToString(sum[:])
+		if previous != nil && store.sameGridFSContent(*previous, hash, len(bin.Data)) {
+			d[i].Value = *previous
+			break
+		}
+		uploadOpts := options.GridFSUpload().SetMetadata(bson.D{{gridFSHashField, hash}})
+		fileId, err := store.gridFS.bucket.UploadFromStream(store.gridFS.field, bytes.NewReader(bin.Data), uploadOpts)
+		if err != nil {
+			return nil, err
+		}
+		d[i].Value = fileId
+		break
+	}
+	return d, nil
+}
+
+//GridFS文件的内容是否和hash、length一致，没有记录hash的旧文件视为不一致
+func (store *MongodbStore[T]) sameGridFSContent(fileId primitive.ObjectID, hash string, length int) bool {
+	cursor, err := store.gridFS.bucket.Find(bson.D{{"_id", fileId}})
+	if err != nil {
+		return false
+	}
+	defer cursor.Close(context.Background())
+	if !cursor.Next(context.Background()) {
+		return false
+	}
+	var file struct {
+		Length   int64    `bson:"length"`
+		Metadata bson.Raw `bson:"metadata"`
+	}
+	if err = cursor.Decode(&file); err != nil || file.Length != int64(length) || file.Metadata == nil {
+		return false
+	}
+	storedHash, ok := file.Metadata.Lookup(gridFSHashField).StringValueOK()
+	return ok && storedHash == hash
+}
+
+//把文档中引用GridFS文件的字段替换成文件内容
+func (store *MongodbStore[T]) resolveGridFSField(ctx context.Context, raw bson.Raw) (bson.Raw, error) {
+	if store.gridFS == nil {
+		return raw, nil
+	}
+	val, err := raw.LookupErr(store.gridFS.field)
+	if err != nil || val.Type != bsontype.ObjectID {
+		return raw, nil
+	}
+	var buf bytes.Buffer
+	if _, err = store.gridFS.bucket.DownloadToStream(val.ObjectID(), &buf); err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err = bson.Unmarshal(raw, &d); err != nil {
+		return nil, err
+	}
+	for i, e := range d {
+		if e.Key == store.gridFS.field {
+			d[i].Value = primitive.Binary{Data: buf.Bytes()}
+			break
+		}
+	}
+	return bson.Marshal(d)
+}
+
+//替换之前读出库里的文档，GridFS文件引用、审计字段和跳过未修改的比较都用这一次读取的结果。
+//不跳过未修改时只取需要的字段，什么都不需要或者文档不存在时返回nil
+func (store *MongodbStore[T]) storedDocument(ctx context.Context, filter any) (bson.Raw, error) {
+	opts := options.FindOne()
+	if !store.skipUnchanged {
+		projection := bson.D{}
+		if store.gridFS != nil {
+			projection = append(projection, bson.E{store.gridFS.field, 1})
+		}
+		if store.audit != nil {
+			projection = append(projection, bson.E{CreatedByField, 1}, bson.E{UpdatedByField, 1})
+		}
+		if len(projection) == 0 {
+			return nil, nil
+		}
+		opts.SetProjection(projection)
+	}
+	raw, err := store.collection().FindOne(ctx, filter, opts).DecodeBytes()
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return raw, err
+}
+
+//库里文档stored引用的GridFS文件id，没有则返回nil
+func (g *gridFSField) rawRef(stored bson.Raw) *primitive.ObjectID {
+	if g == nil || stored == nil {
+		return nil
+	}
+	val, err := stored.LookupErr(g.field)
+	if err != nil || val.Type != bsontype.ObjectID {
+		return nil
+	}
+	fileId := val.ObjectID()
+	return &fileId
+}
+
+//当前库里符合filter的文档引用的所有GridFS文件id
+func (store *MongodbStore[T]) gridFSRefs(ctx context.Context, filter any) ([]primitive.ObjectID, error) {
+	if store.gridFS == nil {
+		return nil, nil
+	}
+	opts := options.Find().SetProjection(bson.D{{store.gridFS.field, 1}})
+	cursor, err := store.collection().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	fileIds := make([]primitive.ObjectID, 0)
+	for cursor.Next(ctx) {
+		val, err := cursor.Current.LookupErr(store.gridFS.field)
+		if err == nil && val.Type == bsontype.ObjectID {
+			fileIds = append(fileIds, val.ObjectID())
+		}
+	}
+	return fileIds, cursor.Err()
+}
+
+func (store *MongodbStore[T]) deleteGridFSFile(ctx context.Context, fileId *primitive.ObjectID) {
+	if store.gridFS == nil || fileId == nil {
+		return
+	}
+	store.gridFS.bucket.Delete(*fileId)
+}
+
+//删除fileId，但它就是keep时不删除。用于写入失败时删除新上传的文件（keep为原来的文件），
+//以及替换成功后删除原来的文件（keep为新文档引用的文件）
+func (store *MongodbStore[T]) deleteGridFSFileUnless(ctx context.Context, fileId *primitive.ObjectID, keep *primitive.ObjectID) {
+	if fileId == nil || (keep != nil && *fileId == *keep) {
+		return
+	}
+	store.deleteGridFSFile(ctx, fileId)
+}
+
+//写入失败时删除这些文档新上传的GridFS文件
+func (store *MongodbStore[T]) discardGridFSFiles(ctx context.Context, docs []any) {
+	for _, doc := range docs {
+		store.deleteGridFSFile(ctx, store.gridFS.ref(doc))
+	}
+}
+
+//用实体整个替换符合filter的文档，带上库里原来的审计字段，并处理GridFS文件：内容没变时继续引用原来的文件，
+//替换成功后删除不再引用的原文件，失败或没有匹配到文档时删除新上传的文件。
+//开启跳过未修改时，在写入操作者之前和库里的文档比较；大字段内容没变时不会上传，所以相同的文档不会留下新文件
+func (store *MongodbStore[T]) replaceDocument(ctx context.Context, filter any, entity any, actor any, opts ...*options.ReplaceOptions) (matched bool, err error) {
+	stored, err := store.storedDocument(ctx, filter)
+	if err != nil {
+		return false, err
+	}
+	oldRef := store.gridFS.rawRef(stored)
+	doc, err := store.toDocumentReusing(ctx, entity, oldRef)
+	if err != nil {
+		return false, err
+	}
+	newRef := store.gridFS.ref(doc)
+	if doc, err = store.carryAudit(doc, stored); err != nil {
+		store.deleteGridFSFileUnless(ctx, newRef, oldRef)
+		return false, err
+	}
+	unchanged, err := store.unchanged(stored, doc)
+	if err != nil || unchanged {
+		store.deleteGridFSFileUnless(ctx, newRef, oldRef)
+		return unchanged, err
+	}
+	if doc, err = store.stampUpdate(doc, actor); err != nil {
+		store.deleteGridFSFileUnless(ctx, newRef, oldRef)
+		return false, err
+	}
+	ur, err := store.collection().ReplaceOne(ctx, filter, doc, opts...)
+	if err != nil || ur.MatchedCount == 0 {
+		store.deleteGridFSFileUnless(ctx, newRef, oldRef)
+		return false, err
+	}
+	store.deleteGridFSFileUnless(ctx, oldRef, newRef)
+	return true, nil
+}
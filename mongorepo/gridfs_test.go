@@ -0,0 +1,80 @@
+package mongorepo_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestGridFSReusesUnchangedContent(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	collection := testCollection(t, client)
+	db := client.Database(testDatabase)
+	bucket, err := gridfs.NewBucket(db, options.GridFSBucket().SetName(collection))
+	if err != nil {
+		t.Fatalf("NewBucket: %v", err)
+	}
+	store := mongorepo.NewMongodbStoreWithGridFS(db.Collection(collection), func() *testDocument { return &testDocument{} }, bucket, "content")
+	fileIdOf := func() primitive.ObjectID {
+		_, raw, _, err := store.LoadRaw(ctx, "d")
+		if err != nil {
+			t.Fatalf("LoadRaw: %v", err)
+		}
+		return raw["content"].(primitive.ObjectID)
+	}
+	fileCount := func() int64 {
+		count, _ := db.Collection(collection+".files").CountDocuments(ctx, bson.D{})
+		return count
+	}
+	if err = store.Save(ctx, "d", &testDocument{"d", []byte("large content")}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	first := fileIdOf()
+	store.UpdateIfPresent(ctx, "d", &testDocument{"d", []byte("large content")})
+	if fileIdOf() != first || fileCount() != 1 {
+		t.Fatalf("unchanged content was uploaded again")
+	}
+	store.UpdateIfPresent(ctx, "d", &testDocument{"d", []byte("changed content")})
+	if fileIdOf() == first || fileCount() != 1 {
+		t.Fatalf("changed content should replace the file: files=%d", fileCount())
+	}
+	doc, _, err := store.Load(ctx, "d")
+	if err != nil || string(doc.Content) != "changed content" {
+		t.Fatalf("Load: %q err=%v", doc.Content, err)
+	}
+}
+
+func TestGridFSRoundTripsBlobOverDocumentLimit(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	collection := testCollection(t, client)
+	db := client.Database(testDatabase)
+	bucket, err := gridfs.NewBucket(db, options.GridFSBucket().SetName(collection))
+	if err != nil {
+		t.Fatalf("NewBucket: %v", err)
+	}
+	store := mongorepo.NewMongodbStoreWithGridFS(db.Collection(collection), func() *testDocument { return &testDocument{} }, bucket, "content")
+	//比MongoDB单个文档的上限还大1MB
+	content := make([]byte, mongorepo.DefaultMaxDocumentSize+1024*1024)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	if err = store.Save(ctx, "big", &testDocument{"big", content}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	doc, found, err := store.Load(ctx, "big")
+	if err != nil || !found {
+		t.Fatalf("Load: found=%v err=%v", found, err)
+	}
+	if !bytes.Equal(doc.Content, content) {
+		t.Fatalf("loaded %d bytes, want the saved %d bytes", len(doc.Content), len(content))
+	}
+}
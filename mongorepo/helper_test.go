@@ -0,0 +1,60 @@
+package mongorepo_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//连接MONGODB_URI指定的MongoDB，没有设置时跳过测试。opts会合并到连接选项中
+func testClient(t testing.TB, opts ...*options.ClientOptions) *mongo.Client {
+	t.Helper()
+	uri := os.Getenv("MONGODB_URI")
+	if uri == "" {
+		t.Skip("MONGODB_URI not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clientOpts := options.MergeClientOptions(append([]*options.ClientOptions{options.Client().ApplyURI(uri)}, opts...)...)
+	client, err := mongo.Connect(ctx, clientOpts)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if err = client.Ping(ctx, nil); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Disconnect(context.Background())
+	})
+	return client
+}
+
+const testDatabase = "arp4g_mongodb_test"
+
+//每个测试使用一个新的集合，测试结束后删除实体集合、锁集合和GridFS集合
+func testCollection(t testing.TB, client *mongo.Client) string {
+	t.Helper()
+	collection := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		db := client.Database(testDatabase)
+		for _, name := range []string{collection, "mutexes_" + collection, collection + ".files", collection + ".chunks"} {
+			db.Collection(name).Drop(context.Background())
+		}
+	})
+	return collection
+}
+
+//不连接服务器的客户端，用于不会真正访问数据库的测试
+func offlineClient(t testing.TB) *mongo.Client {
+	t.Helper()
+	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://127.0.0.1:1"))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	return client
+}
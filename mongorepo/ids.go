@@ -0,0 +1,105 @@
+package mongorepo
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+//对id排序。同类型的字符串、整数、浮点数按自然顺序，其他情况按id的bson编码排序，保证结果在不同进程间一致
+func sortIds(ids []any) {
+	sort.SliceStable(ids, func(i, j int) bool {
+		return lessId(ids[i], ids[j])
+	})
+}
+
+func lessId(a, b any) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.IsValid() && vb.IsValid() && va.Kind() == vb.Kind() {
+		switch va.Kind() {
+		case reflect.String:
+			return va.String() < vb.String()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return va.Int() < vb.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return va.Uint() < vb.Uint()
+		case reflect.Float32, reflect.Float64:
+			return va.Float() < vb.Float()
+		}
+	}
+	ka, _ := idKey(a)
+	kb, _ := idKey(b)
+	return ka < kb
+}
+
+//同一批写入中出现重复id（不同的id值编码成同一个bson值，或者同一个id既要插入又要更新）时的处理方式
+type DuplicateIdPolicy int
+
+const (
+	//返回ErrDuplicateId，不写入任何数据，这是默认方式
+	DuplicateIdFail DuplicateIdPolicy = iota
+	//合并成一个，按先插入后更新、各自按id排序的顺序，保留最后一个。
+	//同一个id既要插入又要更新时，库里还没有这个文档，所以合并成一个插入，内容为更新的实体
+	DuplicateIdLastWins
+)
+
+var ErrDuplicateId = errors.New("duplicate id in batch")
+
+//设置同一批写入中出现重复id时的处理方式
+func (store *MongodbStore[T]) SetDuplicateIdPolicy(policy DuplicateIdPolicy) {
+	store.dupIdPolicy = policy
+}
+
+//insertFromUpdateIds是保留了更新的实体、但需要插入的id
+func (store *MongodbStore[T]) dedupIds(insertIds []any, updateIds []any) (dedupInsertIds []any, insertFromUpdateIds []any, dedupUpdateIds []any, err error) {
+	all := append(append(make([]any, 0, len(insertIds)+len(updateIds)), insertIds...), updateIds...)
+	keys := make([]string, len(all))
+	lastIdx := make(map[string]int, len(all))
+	for i, id := range all {
+		mid, err := store.marshalId(id)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if keys[i], err = idKey(mid); err != nil {
+			return nil, nil, nil, err
+		}
+		if _, dup := lastIdx[keys[i]]; dup && store.dupIdPolicy == DuplicateIdFail {
+			return nil, nil, nil, fmt.Errorf("%w: %v", ErrDuplicateId, id)
+		}
+		lastIdx[keys[i]] = i
+	}
+	if len(lastIdx) == len(all) {
+		return insertIds, nil, updateIds, nil
+	}
+	inserted := make(map[string]bool, len(insertIds))
+	for i := range insertIds {
+		inserted[keys[i]] = true
+	}
+	dedupInsertIds = make([]any, 0, len(insertIds))
+	dedupUpdateIds = make([]any, 0, len(updateIds))
+	for i, id := range all {
+		if lastIdx[keys[i]] != i {
+			continue
+		}
+		if i < len(insertIds) {
+			dedupInsertIds = append(dedupInsertIds, id)
+		} else if inserted[keys[i]] {
+			insertFromUpdateIds = append(insertFromUpdateIds, id)
+		} else {
+			dedupUpdateIds = append(dedupUpdateIds, id)
+		}
+	}
+	return dedupInsertIds, insertFromUpdateIds, dedupUpdateIds, nil
+}
+
+//把库里读出的id转换成可以作为map key的值，无法转换的使用其字符串表示
+func rawIdValue(rawId bson.RawValue) any {
+	var id any
+	if err := rawId.Unmarshal(&id); err == nil && id != nil && reflect.TypeOf(id).Comparable() {
+		return id
+	}
+	return rawId.String()
+}
@@ -0,0 +1,69 @@
+package mongorepo
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSortIds(t *testing.T) {
+	strs := []any{"c", "a", "b"}
+	sortIds(strs)
+	if want := []any{"a", "b", "c"}; !reflect.DeepEqual(strs, want) {
+		t.Fatalf("sortIds(strings) = %v, want %v", strs, want)
+	}
+	//整数按数值而不是字符串排序
+	ints := []any{10, 2, 33, -1}
+	sortIds(ints)
+	if want := []any{-1, 2, 10, 33}; !reflect.DeepEqual(ints, want) {
+		t.Fatalf("sortIds(ints) = %v, want %v", ints, want)
+	}
+}
+
+func TestSortIdsMixedTypesIsDeterministic(t *testing.T) {
+	a := []any{"b", 2, "a", 1.5, int64(7)}
+	b := []any{int64(7), 1.5, "a", 2, "b"}
+	sortIds(a)
+	sortIds(b)
+	if !reflect.DeepEqual(a, b) {
+		t.Fatalf("sortIds is order dependent: %v vs %v", a, b)
+	}
+}
+
+func TestDedupIdsWithoutDuplicates(t *testing.T) {
+	store := NewMongodbStore[*testEntity](nil, newTestEntity)
+	inserts, insertFromUpdates, updates, err := store.dedupIds([]any{"a", "b"}, []any{"c"})
+	if err != nil {
+		t.Fatalf("dedupIds: %v", err)
+	}
+	if !reflect.DeepEqual(inserts, []any{"a", "b"}) || len(insertFromUpdates) != 0 || !reflect.DeepEqual(updates, []any{"c"}) {
+		t.Fatalf("dedupIds = %v %v %v", inserts, insertFromUpdates, updates)
+	}
+}
+
+func TestDedupIdsFailByDefault(t *testing.T) {
+	store := NewMongodbStore[*testEntity](nil, newTestEntity)
+	_, _, _, err := store.dedupIds([]any{"a"}, []any{"a"})
+	if !errors.Is(err, ErrDuplicateId) {
+		t.Fatalf("dedupIds error = %v, want ErrDuplicateId", err)
+	}
+}
+
+func TestDedupIdsLastWins(t *testing.T) {
+	store := NewMongodbStore[*testEntity](nil, newTestEntity)
+	store.SetDuplicateIdPolicy(DuplicateIdLastWins)
+	inserts, insertFromUpdates, updates, err := store.dedupIds([]any{"a", "b"}, []any{"b", "c"})
+	if err != nil {
+		t.Fatalf("dedupIds: %v", err)
+	}
+	//b既要插入又要更新，合并成用更新的实体插入
+	if !reflect.DeepEqual(inserts, []any{"a"}) {
+		t.Fatalf("inserts = %v, want [a]", inserts)
+	}
+	if !reflect.DeepEqual(insertFromUpdates, []any{"b"}) {
+		t.Fatalf("insertFromUpdates = %v, want [b]", insertFromUpdates)
+	}
+	if !reflect.DeepEqual(updates, []any{"c"}) {
+		t.Fatalf("updates = %v, want [c]", updates)
+	}
+}
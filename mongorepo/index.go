@@ -0,0 +1,74 @@
+package mongorepo
+
+import (
+	"context"
+	"time"
+
+	"github.com/framework-arp/ARP4G/arp"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const DefaultExpireAtField = "expireAt"
+
+//在实体集合（不是锁集合）的field字段上建立TTL索引。field为空时使用expireAt。
+//字段值为时间的实体会在该时间之后再过expireAfter被MongoDB自动删除，expireAfter为0就是到点即删。
+//MongoDB的TTL后台任务大约每60秒执行一次，所以删除并不是即时的
+func (repo *MongodbRepository[T]) EnsureTTLIndex(ctx context.Context, field string, expireAfter time.Duration) error {
+	if repo.coll == nil {
+		return nil
+	}
+	if field == "" {
+		field = DefaultExpireAtField
+	}
+	model := mongo.IndexModel{
+		Keys:    bson.D{{field, 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(expireAfter / time.Second)),
+	}
+	_, err := repo.coll.Indexes().CreateOne(ctx, model)
+	return err
+}
+
+//创建仓库并在实体集合的expireAtField字段上建立TTL索引，见EnsureTTLIndex。建立索引失败时返回错误
+func NewMongodbRepositoryWithTTL[T any](ctx context.Context, client *mongo.Client, database string, collection string, newZeroEntity arp.NewZeroEntity[T],
+	expireAtField string, expireAfter time.Duration) (*MongodbRepository[T], error) {
+	repo := NewMongodbRepository(client, database, collection, newZeroEntity)
+	if err := repo.EnsureTTLIndex(ctx, expireAtField, expireAfter); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+//在实体集合的fieldName字段上建立索引，unique为true时建立唯一索引
+func (repo *MongodbRepository[T]) EnsureFieldIndex(ctx context.Context, fieldName string, unique bool) error {
+	return repo.EnsureFieldIndexWithPartialFilter(ctx, fieldName, unique, nil)
+}
+
+//建立只对符合partialFilter的文档生效的索引。例如唯一索引只约束未删除的文档：
+//repo.EnsureFieldIndexWithPartialFilter(ctx, "email", true, bson.D{{"deleted", false}})
+//注意查询条件需要包含partialFilter，MongoDB才会使用这个索引
+func (repo *MongodbRepository[T]) EnsureFieldIndexWithPartialFilter(ctx context.Context, fieldName string, unique bool, partialFilter bson.D) error {
+	if repo.coll == nil {
+		return nil
+	}
+	opts := options.Index().SetUnique(unique)
+	if partialFilter != nil {
+		opts.SetPartialFilterExpression(partialFilter)
+	}
+	_, err := repo.coll.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{fieldName, 1}}, Options: opts})
+	return err
+}
+
+//在后台建立字段索引，立即返回，不阻塞服务启动。
+//建索引的结果（nil或错误）会发到返回的channel后关闭channel，调用者可以等待它，也可以另起goroutine记录错误。
+//ctx会一直用到索引建完，不要传入启动流程结束就取消的ctx
+func (repo *MongodbRepository[T]) EnsureFieldIndexAsync(ctx context.Context, fieldName string, unique bool) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		defer close(done)
+		done <- repo.EnsureFieldIndex(ctx, fieldName, unique)
+	}()
+	return done
+}
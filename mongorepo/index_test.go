@@ -0,0 +1,85 @@
+package mongorepo_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestNewMongodbRepositoryWithTTL(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	collection := testCollection(t, client)
+	_, err := mongorepo.NewMongodbRepositoryWithTTL(ctx, client, testDatabase, collection, newTestOrder, "", 90*time.Second)
+	if err != nil {
+		t.Fatalf("NewMongodbRepositoryWithTTL: %v", err)
+	}
+	specs, err := client.Database(testDatabase).Collection(collection).Indexes().ListSpecifications(ctx)
+	if err != nil {
+		t.Fatalf("ListSpecifications: %v", err)
+	}
+	for _, spec := range specs {
+		if spec.Name == mongorepo.DefaultExpireAtField+"_1" {
+			if spec.ExpireAfterSeconds == nil || *spec.ExpireAfterSeconds != 90 {
+				t.Fatalf("expireAfterSeconds = %v, want 90", spec.ExpireAfterSeconds)
+			}
+			return
+		}
+	}
+	t.Fatalf("TTL index not found in %v", specs)
+}
+
+func TestEnsureFieldIndexWithPartialFilter(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	collection := testCollection(t, client)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, collection, newTestOrder)
+	//只有qty大于0的订单status唯一
+	err := repo.EnsureFieldIndexWithPartialFilter(ctx, "status", true, bson.D{{"qty", bson.D{{"$gt", 0}}}})
+	if err != nil {
+		t.Fatalf("EnsureFieldIndexWithPartialFilter: %v", err)
+	}
+	coll := client.Database(testDatabase).Collection(collection)
+	if _, err = coll.InsertOne(ctx, &testOrder{"o1", "open", 1}); err != nil {
+		t.Fatalf("insert o1: %v", err)
+	}
+	for _, id := range []string{"o2", "o3"} {
+		if _, err = coll.InsertOne(ctx, &testOrder{id, "open", 0}); err != nil {
+			t.Fatalf("duplicate outside the filter %s: %v", id, err)
+		}
+	}
+	if _, err = coll.InsertOne(ctx, &testOrder{"o4", "open", 2}); !mongo.IsDuplicateKeyError(err) {
+		t.Fatalf("duplicate inside the filter: %v, want a duplicate key error", err)
+	}
+}
+
+func TestEnsureFieldIndexAsync(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	collection := testCollection(t, client)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, collection, newTestOrder)
+	done := repo.EnsureFieldIndexAsync(ctx, "status", false)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("index build: %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("index build did not finish")
+	}
+	specs, err := client.Database(testDatabase).Collection(collection).Indexes().ListSpecifications(ctx)
+	if err != nil {
+		t.Fatalf("ListSpecifications: %v", err)
+	}
+	for _, spec := range specs {
+		if spec.Name == "status_1" {
+			return
+		}
+	}
+	t.Fatalf("index status_1 not found in %v", specs)
+}
@@ -0,0 +1,93 @@
+package mongorepo
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//无序批量插入中某个文档的失败
+type InsertFailure struct {
+	//文档在这一批中的位置（按id排序之后）
+	Index int
+	Id    any
+	Code  int
+	Err   error
+}
+
+//无序批量插入的结果
+type InsertAllResult struct {
+	InsertedIds []any
+	Failures    []InsertFailure
+}
+
+//无序批量插入，一个文档失败不影响其他文档。每个文档的失败（例如违反唯一索引）记录在result.Failures中，
+//这种情况下err为nil；err不为nil表示整批的错误（例如连接失败），此时result中只有能确定的部分
+func (store *MongodbStore[T]) InsertAll(ctx context.Context, entities map[any]T) (result *InsertAllResult, err error) {
+	result = &InsertAllResult{InsertedIds: make([]any, 0, len(entities)), Failures: make([]InsertFailure, 0)}
+	if len(entities) == 0 {
+		return result, nil
+	}
+	ids := make([]any, 0, len(entities))
+	for id := range entities {
+		ids = append(ids, id)
+	}
+	sortIds(ids)
+	actor, err := store.auditActor(ctx)
+	if err != nil {
+		return result, err
+	}
+	docs := make([]any, 0, len(ids))
+	for _, id := range ids {
+		if err = store.checkBeforeWrite(id, entities[id]); err != nil {
+			store.discardGridFSFiles(ctx, docs)
+			return result, err
+		}
+		doc, err := store.toDocument(ctx, entities[id])
+		if err != nil {
+			store.discardGridFSFiles(ctx, docs)
+			return result, err
+		}
+		stamped, err := store.stampInsert(doc, actor)
+		if err != nil {
+			store.discardGridFSFiles(ctx, append(docs, doc))
+			return result, err
+		}
+		docs = append(docs, stamped)
+	}
+	opts := options.InsertMany().SetOrdered(false).SetBypassDocumentValidation(store.bypassValidation)
+	_, err = store.collection().InsertMany(ctx, docs, opts)
+	if err == nil {
+		result.InsertedIds = append(result.InsertedIds, ids...)
+		return result, nil
+	}
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || bwe.WriteConcernError != nil {
+		return result, err
+	}
+	failed := make(map[int]bool, len(bwe.WriteErrors))
+	for _, we := range bwe.WriteErrors {
+		failed[we.Index] = true
+		var id any
+		if we.Index >= 0 && we.Index < len(ids) {
+			id = ids[we.Index]
+			store.deleteGridFSFile(ctx, store.gridFS.ref(docs[we.Index]))
+		}
+		result.Failures = append(result.Failures, InsertFailure{we.Index, id, we.Code, errors.New(we.Message)})
+	}
+	for i, id := range ids {
+		if !failed[i] {
+			result.InsertedIds = append(result.InsertedIds, id)
+		}
+	}
+	return result, nil
+}
+
+func (repo *MongodbRepository[T]) InsertAll(ctx context.Context, entities map[any]T) (*InsertAllResult, error) {
+	if repo.store == nil {
+		return &InsertAllResult{}, nil
+	}
+	return repo.store.InsertAll(ctx, entities)
+}
@@ -0,0 +1,49 @@
+package mongorepo_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+)
+
+func TestInsertAllReportsEachFailedDocument(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, testCollection(t, client), newTestOrder)
+	if err := repo.EnsureFieldIndex(ctx, "status", true); err != nil {
+		t.Fatalf("EnsureFieldIndex: %v", err)
+	}
+	repo.InsertIfAbsent(ctx, "x", &testOrder{"x", "s2", 0})
+	//b和库里已有的x冲突，d和同一批里的c冲突
+	result, err := repo.InsertAll(ctx, map[any]*testOrder{
+		"a": {"a", "s1", 1},
+		"b": {"b", "s2", 2},
+		"c": {"c", "s3", 3},
+		"d": {"d", "s3", 4},
+		"e": {"e", "s5", 5},
+	})
+	if err != nil {
+		t.Fatalf("InsertAll: %v", err)
+	}
+	if !reflect.DeepEqual(result.InsertedIds, []any{"a", "c", "e"}) {
+		t.Fatalf("InsertedIds = %v, want [a c e]", result.InsertedIds)
+	}
+	if len(result.Failures) != 2 {
+		t.Fatalf("Failures = %+v, want 2", result.Failures)
+	}
+	for i, want := range []struct {
+		index int
+		id    any
+	}{{1, "b"}, {3, "d"}} {
+		failure := result.Failures[i]
+		if failure.Index != want.index || failure.Id != want.id || failure.Code != 11000 || failure.Err == nil {
+			t.Fatalf("Failures[%d] = %+v, want index %d id %v with a duplicate key error", i, failure, want.index, want.id)
+		}
+	}
+	count, _ := repo.Count(ctx)
+	if count != 4 {
+		t.Fatalf("count = %d, want 4", count)
+	}
+}
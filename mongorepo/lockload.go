@@ -0,0 +1,52 @@
+package mongorepo
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrLockNotAcquired = errors.New("can not acquire lock since entity is occupied")
+
+//先上锁再加载，保证加载上来的实体就是被锁保护的那个。拿不到锁时返回ErrLockNotAcquired。
+//找到实体时锁由调用者持有，用完需要调用Unlock释放；没找到或者出错时锁会自动释放
+func (repo *MongodbRepository[T]) LoadForUpdate(ctx context.Context, id any) (entity T, found bool, err error) {
+	if repo.store == nil {
+		return entity, false, nil
+	}
+	ok, absent, err := repo.mutexes.Lock(ctx, id)
+	if err != nil {
+		return entity, false, err
+	}
+	if absent {
+		//锁不存在，实体存在的话补锁
+		if _, found, err = repo.store.Load(ctx, id); err != nil || !found {
+			return entity, false, err
+		}
+		if ok, err = repo.mutexes.NewAndLock(ctx, id); err != nil {
+			return entity, false, err
+		}
+		if !ok {
+			//有人抢先补锁，再去获得锁
+			if ok, _, err = repo.mutexes.Lock(ctx, id); err != nil {
+				return entity, false, err
+			}
+		}
+	}
+	if !ok {
+		return entity, false, ErrLockNotAcquired
+	}
+	entity, found, err = repo.store.Load(ctx, id)
+	if err != nil || !found {
+		repo.Unlock(ctx, id)
+		return entity, false, err
+	}
+	return entity, true, nil
+}
+
+//释放LoadForUpdate获得的锁
+func (repo *MongodbRepository[T]) Unlock(ctx context.Context, id any) {
+	if repo.mutexes == nil {
+		return
+	}
+	repo.mutexes.UnlockAll(ctx, []any{id})
+}
@@ -0,0 +1,68 @@
+package mongorepo_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestLoadForUpdateSerializes(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, testCollection(t, client), newTestOrder)
+	if _, err := repo.InsertIfAbsent(ctx, "a", &testOrder{"a", "new", 0}); err != nil {
+		t.Fatalf("InsertIfAbsent: %v", err)
+	}
+	const workers, rounds = 2, 10
+	var inside, overlaps int32
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; {
+				order, found, err := repo.LoadForUpdate(ctx, "a")
+				if errors.Is(err, mongorepo.ErrLockNotAcquired) {
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				if err != nil || !found {
+					errs <- err
+					return
+				}
+				if atomic.AddInt32(&inside, 1) > 1 {
+					atomic.AddInt32(&overlaps, 1)
+				}
+				order.Qty++
+				_, err = repo.UpdateIfPresent(ctx, "a", order)
+				atomic.AddInt32(&inside, -1)
+				repo.Unlock(ctx, "a")
+				if err != nil {
+					errs <- err
+					return
+				}
+				i++
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("LoadForUpdate worker: %v", err)
+	}
+	if overlaps > 0 {
+		t.Fatalf("%d LoadForUpdate calls overlapped", overlaps)
+	}
+	order, _, err := repo.FindOne(ctx, bson.D{{"_id", "a"}})
+	if err != nil || order.Qty != workers*rounds {
+		t.Fatalf("qty = %d err=%v, want %d (lost updates)", order.Qty, err, workers*rounds)
+	}
+}
@@ -0,0 +1,124 @@
+package mongorepo
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/framework-arp/ARP4G/arp"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var ErrAlreadyExists = errors.New("entity already exists")
+
+//内存中的store，行为和MongodbStore一致（实体经过bson编解码保存，加载上来的是副本，重复插入会失败，更新不存在的实体不生效），
+//用于在没有MongoDB的情况下测试store层
+type MemoryStore[T any] struct {
+	mutex         sync.RWMutex
+	docs          map[string]bson.Raw
+	newZeroEntity arp.NewZeroEntity[T]
+}
+
+func NewMemoryStore[T any](newZeroEntity arp.NewZeroEntity[T]) *MemoryStore[T] {
+	return &MemoryStore[T]{docs: make(map[string]bson.Raw), newZeroEntity: newZeroEntity}
+}
+
+func (store *MemoryStore[T]) Load(ctx context.Context, id any) (entity T, found bool, err error) {
+	key, err := idKey(id)
+	if err != nil {
+		return entity, false, err
+	}
+	store.mutex.RLock()
+	doc, ok := store.docs[key]
+	store.mutex.RUnlock()
+	if !ok {
+		return entity, false, nil
+	}
+	entity = store.newZeroEntity()
+	if err = bson.Unmarshal(doc, entity); err != nil {
+		return entity, false, err
+	}
+	return entity, true, nil
+}
+
+func (store *MemoryStore[T]) Save(ctx context.Context, id any, entity T) error {
+	if err := validateEntity(entity); err != nil {
+		return err
+	}
+	key, doc, err := store.marshal(id, entity)
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.docs[key]; ok {
+		return ErrAlreadyExists
+	}
+	store.docs[key] = doc
+	return nil
+}
+
+func (store *MemoryStore[T]) SaveAll(ctx context.Context, entitiesToInsert map[any]any, entitiesToUpdate map[any]*arp.ProcessEntity) error {
+	inserts := make(map[string]bson.Raw, len(entitiesToInsert))
+	for k, v := range entitiesToInsert {
+		if err := validateEntity(v); err != nil {
+			return err
+		}
+		key, doc, err := store.marshal(k, v)
+		if err != nil {
+			return err
+		}
+		inserts[key] = doc
+	}
+	updates := make(map[string]bson.Raw, len(entitiesToUpdate))
+	for k, v := range entitiesToUpdate {
+		if err := validateEntity(v.Entity()); err != nil {
+			return err
+		}
+		key, doc, err := store.marshal(k, v.Entity())
+		if err != nil {
+			return err
+		}
+		updates[key] = doc
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for key := range inserts {
+		if _, ok := store.docs[key]; ok {
+			return ErrAlreadyExists
+		}
+	}
+	for key, doc := range inserts {
+		store.docs[key] = doc
+	}
+	for key, doc := range updates {
+		if _, ok := store.docs[key]; ok {
+			store.docs[key] = doc
+		}
+	}
+	return nil
+}
+
+func (store *MemoryStore[T]) RemoveAll(ctx context.Context, ids []any) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, id := range ids {
+		key, err := idKey(id)
+		if err != nil {
+			return err
+		}
+		delete(store.docs, key)
+	}
+	return nil
+}
+
+func (store *MemoryStore[T]) marshal(id any, entity any) (key string, doc bson.Raw, err error) {
+	if key, err = idKey(id); err != nil {
+		return "", nil, err
+	}
+	if doc, err = bson.Marshal(entity); err != nil {
+		return "", nil, err
+	}
+	return key, doc, nil
+}
@@ -0,0 +1,33 @@
+package mongorepo
+
+import (
+	"context"
+	"testing"
+)
+
+type testEntity struct {
+	Id   string `bson:"_id"`
+	Name string `bson:"name"`
+	Data []byte `bson:"data,omitempty"`
+}
+
+func newTestEntity() *testEntity {
+	return &testEntity{}
+}
+
+func TestMemoryStoreLoadReturnsCopy(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(newTestEntity)
+	if err := store.Save(ctx, "a", &testEntity{Id: "a", Name: "x"}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	first, _, _ := store.Load(ctx, "a")
+	first.Name = "changed"
+	second, found, err := store.Load(ctx, "a")
+	if err != nil || !found {
+		t.Fatalf("Load: found=%v err=%v", found, err)
+	}
+	if second.Name != "x" {
+		t.Fatalf("modifying a loaded entity changed the store: got %q", second.Name)
+	}
+}
@@ -0,0 +1,91 @@
+package mongorepo
+
+import (
+	"sync"
+	"time"
+)
+
+//观察上锁的等待时间。设置给MongodbMutexes的observer如果同时实现了这个接口，每次Lock（锁存在的情况下）结束时都会被调用，
+//wait为这次Lock花费的时间，ok为是否拿到了锁
+type LockWaitObserver interface {
+	LockWaited(id any, wait time.Duration, ok bool)
+}
+
+//默认的等待时间分桶上界
+var DefaultLockWaitBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+//内置的上锁等待时间直方图，同时记录抢锁次数。可以直接作为MongodbMutexes的observer使用
+type LockWaitHistogram struct {
+	mutex  sync.Mutex
+	bounds []time.Duration
+	counts []uint64
+	total  uint64
+	sum    time.Duration
+	failed uint64
+	stolen uint64
+}
+
+//分桶上界bounds需要从小到大排列，为空则使用DefaultLockWaitBuckets。超过最大上界的计入最后一个桶
+func NewLockWaitHistogram(bounds []time.Duration) *LockWaitHistogram {
+	if len(bounds) == 0 {
+		bounds = DefaultLockWaitBuckets
+	}
+	return &LockWaitHistogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *LockWaitHistogram) LockWaited(id any, wait time.Duration, ok bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	i := 0
+	for i < len(h.bounds) && wait > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.total++
+	h.sum += wait
+	if !ok {
+		h.failed++
+	}
+}
+
+func (h *LockWaitHistogram) LockStolen(id any, previousLockTime uint64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.stolen++
+}
+
+//直方图的一个桶，UpperBound为0表示超过最大上界的那个桶
+type LockWaitBucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+//各个桶的计数（非累积），最后一个桶是超过最大上界的
+func (h *LockWaitHistogram) Buckets() []LockWaitBucket {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	buckets := make([]LockWaitBucket, len(h.counts))
+	for i, count := range h.counts {
+		if i < len(h.bounds) {
+			buckets[i].UpperBound = h.bounds[i]
+		}
+		buckets[i].Count = count
+	}
+	return buckets
+}
+
+//总次数，总等待时间，没拿到锁的次数，抢锁次数
+func (h *LockWaitHistogram) Stats() (total uint64, sum time.Duration, failed uint64, stolen uint64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.total, h.sum, h.failed, h.stolen
+}
@@ -0,0 +1,36 @@
+package mongorepo
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLockWaitHistogram(t *testing.T) {
+	h := NewLockWaitHistogram([]time.Duration{10 * time.Millisecond, 100 * time.Millisecond})
+	h.LockWaited("a", 5*time.Millisecond, true)
+	h.LockWaited("b", 10*time.Millisecond, true)
+	h.LockWaited("c", 50*time.Millisecond, true)
+	h.LockWaited("d", time.Second, false)
+	h.LockStolen("e", 0)
+
+	want := []LockWaitBucket{
+		{10 * time.Millisecond, 2},
+		{100 * time.Millisecond, 1},
+		{0, 1},
+	}
+	if buckets := h.Buckets(); !reflect.DeepEqual(buckets, want) {
+		t.Fatalf("Buckets() = %v, want %v", buckets, want)
+	}
+	total, sum, failed, stolen := h.Stats()
+	if total != 4 || sum != 1065*time.Millisecond || failed != 1 || stolen != 1 {
+		t.Fatalf("Stats() = %d %v %d %d", total, sum, failed, stolen)
+	}
+}
+
+func TestLockWaitHistogramDefaultBuckets(t *testing.T) {
+	h := NewLockWaitHistogram(nil)
+	if n := len(h.Buckets()); n != len(DefaultLockWaitBuckets)+1 {
+		t.Fatalf("len(Buckets()) = %d, want %d", n, len(DefaultLockWaitBuckets)+1)
+	}
+}
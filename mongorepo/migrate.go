@@ -0,0 +1,35 @@
+package mongorepo
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+//实体结构升级。Load解码之后调用，raw为库里的原始文档，可以根据其中的版本字段把entity在内存中升级成当前的结构，
+//返回upgraded表示是否做了升级
+type Migrator[T any] func(ctx context.Context, raw bson.Raw, entity T) (upgraded bool, err error)
+
+//设置实体结构升级，persist为true时升级后的实体会写回库里。
+//只有库里的文档仍然是加载时读到的那个时才写回，加载之后被其他人改过的文档不会被覆盖
+func (store *MongodbStore[T]) SetMigrator(migrator Migrator[T], persist bool) {
+	store.migrator = migrator
+	store.persistMigrate = persist
+}
+
+func (store *MongodbStore[T]) migrate(ctx context.Context, filter any, raw bson.Raw, entity T) error {
+	if store.migrator == nil {
+		return nil
+	}
+	upgraded, err := store.migrator(ctx, raw, entity)
+	if err != nil || !upgraded || !store.persistMigrate {
+		return err
+	}
+	//整个文档和读到的raw相同才替换，$literal避免raw中以$开头的字符串被当作字段路径
+	unchangedFilter := bson.D{{"$and", bson.A{
+		filter,
+		bson.D{{"$expr", bson.D{{"$eq", bson.A{"$$ROOT", bson.D{{"$literal", raw}}}}}}},
+	}}}
+	_, err = store.replaceDocument(ctx, unchangedFilter, entity, nil)
+	return err
+}
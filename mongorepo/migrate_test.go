@@ -0,0 +1,73 @@
+package mongorepo_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+//v1的文档用quantity记录数量，当前结构改成了qty
+func migrateOrderV1(ctx context.Context, raw bson.Raw, order *testOrder) (bool, error) {
+	if _, err := raw.LookupErr("qty"); err == nil {
+		return false, nil
+	}
+	quantity, ok := raw.Lookup("quantity").AsInt64OK()
+	if !ok {
+		return false, nil
+	}
+	order.Qty = int(quantity)
+	return true, nil
+}
+
+func TestMigratorUpgradesV1Documents(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	coll := client.Database(testDatabase).Collection(testCollection(t, client))
+	if _, err := coll.InsertOne(ctx, bson.D{{"_id", "o1"}, {"status", "new"}, {"quantity", 3}}); err != nil {
+		t.Fatalf("InsertOne: %v", err)
+	}
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	store.SetMigrator(migrateOrderV1, true)
+	order, found, err := store.Load(ctx, "o1")
+	if err != nil || !found || *order != (testOrder{"o1", "new", 3}) {
+		t.Fatalf("Load = %+v found=%v err=%v, want the upgraded order", order, found, err)
+	}
+	var stored bson.M
+	if err = coll.FindOne(ctx, bson.D{{"_id", "o1"}}).Decode(&stored); err != nil {
+		t.Fatalf("FindOne: %v", err)
+	}
+	if stored["qty"] != int32(3) || stored["quantity"] != nil {
+		t.Fatalf("stored = %v, want the current shape", stored)
+	}
+}
+
+func TestMigratorDoesNotOverwriteConcurrentChange(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	coll := client.Database(testDatabase).Collection(testCollection(t, client))
+	if _, err := coll.InsertOne(ctx, bson.D{{"_id", "o1"}, {"status", "new"}, {"quantity", 3}}); err != nil {
+		t.Fatalf("InsertOne: %v", err)
+	}
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	//升级的同时文档被其他人修改
+	store.SetMigrator(func(ctx context.Context, raw bson.Raw, order *testOrder) (bool, error) {
+		if _, err := coll.UpdateOne(ctx, bson.D{{"_id", "o1"}}, bson.D{{"$set", bson.D{{"status", "paid"}}}}); err != nil {
+			return false, err
+		}
+		return migrateOrderV1(ctx, raw, order)
+	}, true)
+	order, found, err := store.Load(ctx, "o1")
+	if err != nil || !found || order.Qty != 3 {
+		t.Fatalf("Load = %+v found=%v err=%v, want the upgraded order", order, found, err)
+	}
+	var stored bson.M
+	if err = coll.FindOne(ctx, bson.D{{"_id", "o1"}}).Decode(&stored); err != nil {
+		t.Fatalf("FindOne: %v", err)
+	}
+	if stored["status"] != "paid" || stored["quantity"] != int32(3) || stored["qty"] != nil {
+		t.Fatalf("stored = %v, want the concurrent change kept", stored)
+	}
+}
@@ -3,90 +3,653 @@ package mongorepo
 import (
 	"context"
 	"errors"
+	"fmt"
+	"os"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/framework-arp/ARP4G/arp"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
 type MongodbStore[T any] struct {
-	coll          *mongo.Collection
-	newZeroEntity arp.NewZeroEntity[T]
+	coll            *mongo.Collection
+	collProvider    func() *mongo.Collection
+	newZeroEntity   arp.NewZeroEntity[T]
+	idField         string
+	registry        *bsoncodec.Registry
+	writeBuffer     *writeBuffer
+	dupIdPolicy     DuplicateIdPolicy
+	maxDocSize      int
+	gridFS          *gridFSField
+	removeChunkSize int
+
+	loadAllBatchSize   int
+	loadAllConcurrency int
+
+	migrator       Migrator[T]
+	persistMigrate bool
+
+	bypassValidation bool
+
+	audit *auditConfig
+
+	tracer Tracer
+
+	skipUnchanged  bool
+	skippedUpdates uint64
+}
+
+//Save、SaveAll和写缓冲的写入是否绕过集合的schema校验(validator)，默认不绕过。用于管理或数据迁移工具写入不符合校验规则的文档
+func (store *MongodbStore[T]) SetBypassDocumentValidation(bypass bool) {
+	store.bypassValidation = bypass
+}
+
+const defaultIdField = "_id"
+
+//设置编解码使用的registry，id和实体都会用它来编码，保证自定义类型的id在Save和Load之间一致
+func (store *MongodbStore[T]) SetRegistry(registry *bsoncodec.Registry) error {
+	if store.coll != nil {
+		coll, err := store.coll.Clone(options.Collection().SetRegistry(registry))
+		if err != nil {
+			return err
+		}
+		store.coll = coll
+	}
+	store.registry = registry
+	return nil
+}
+
+//每次操作使用的集合。使用collProvider时每次都取最新的集合，以支持替换客户端
+func (store *MongodbStore[T]) collection() *mongo.Collection {
+	if store.collProvider == nil {
+		return store.coll
+	}
+	coll := store.collProvider()
+	if store.registry != bson.DefaultRegistry {
+		if cloned, err := coll.Clone(options.Collection().SetRegistry(store.registry)); err == nil {
+			return cloned
+		}
+	}
+	return coll
+}
+
+//把id用registry编码成bson值再用于查询条件，避免自定义类型的id编码结果和保存时不一致
+func (store *MongodbStore[T]) marshalId(id any) (any, error) {
+	switch id.(type) {
+	case bson.RawValue, primitive.ObjectID:
+		return id, nil
+	}
+	t, data, err := bson.MarshalValueWithRegistry(store.registry, id)
+	if err != nil {
+		return nil, err
+	}
+	return bson.RawValue{Type: t, Value: data}, nil
+}
+
+func (store *MongodbStore[T]) idFilter(id any) (bson.D, error) {
+	mid, err := store.marshalId(id)
+	if err != nil {
+		return nil, err
+	}
+	return bson.D{{store.idField, mid}}, nil
+}
+
+//设置文档中存放id的字段名，默认为_id
+func (store *MongodbStore[T]) SetIdField(idField string) {
+	store.idField = idField
 }
 
 func (store *MongodbStore[T]) Load(ctx context.Context, id any) (entity T, found bool, err error) {
-	filter := bson.D{{"_id", id}}
-	sr := store.coll.FindOne(ctx, filter)
-	if err = sr.Err(); err == mongo.ErrNoDocuments {
-		return entity, false, nil
-	}
-	var result bson.D
-	sr.Decode(&result)
-	var doc []byte
-	if doc, err = bson.Marshal(result); err != nil {
+	ctx, span := store.startSpan(ctx, "Load")
+	defer func() { span.End(err) }()
+	store.flushBeforeRead(ctx)
+	filter, err := store.idFilter(id)
+	if err != nil {
+		return entity, false, err
+	}
+	raw, err := store.collection().FindOne(ctx, filter).DecodeBytes()
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return entity, false, nil
+		}
+		return entity, false, err
+	}
+	if entity, err = store.decode(ctx, raw); err != nil {
+		return entity, false, err
+	}
+	if err = store.migrate(ctx, filter, raw, entity); err != nil {
 		return entity, false, err
 	}
-	entity = store.newZeroEntity()
-	bson.Unmarshal(doc, entity)
 	return entity, true, nil
 }
 
-func (store *MongodbStore[T]) Save(ctx context.Context, id any, entity T) error {
-	_, err := store.coll.InsertOne(ctx, entity)
+//加载实体的同时返回完整的原始文档，可以读到实体结构体中没有的字段
+func (store *MongodbStore[T]) LoadRaw(ctx context.Context, id any) (entity T, raw bson.M, found bool, err error) {
+	store.flushBeforeRead(ctx)
+	filter, err := store.idFilter(id)
+	if err != nil {
+		return entity, nil, false, err
+	}
+	doc, err := store.collection().FindOne(ctx, filter).DecodeBytes()
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return entity, nil, false, nil
+		}
+		return entity, nil, false, err
+	}
+	if err = bson.Unmarshal(doc, &raw); err != nil {
+		return entity, nil, false, err
+	}
+	if entity, err = store.decode(ctx, doc); err != nil {
+		return entity, raw, false, err
+	}
+	return entity, raw, true, nil
+}
+
+//批量加载，返回的map以传入的id为key。某个文档解码失败不影响其他文档，解码失败的会汇总在返回的*DecodeErrors中。
+//设置了SetLoadAllBatching时，id会被分成多批并发查询，再合并结果。ctx中带有会话时各批依次查询
+func (store *MongodbStore[T]) LoadAll(ctx context.Context, ids []any) (entities map[any]T, err error) {
+	entities = make(map[any]T, len(ids))
+	if len(ids) == 0 {
+		return entities, nil
+	}
+	store.flushBeforeRead(ctx)
+	decodeErrs := &DecodeErrors{}
+	batchSize := store.loadAllBatchSize
+	if batchSize <= 0 || len(ids) <= batchSize {
+		if err = store.loadChunk(ctx, ids, entities, decodeErrs); err != nil {
+			return entities, err
+		}
+	} else if mongo.SessionFromContext(ctx) != nil {
+		//同一个会话不能被并发使用，只能逐批查询
+		for start := 0; start < len(ids); start += batchSize {
+			end := start + batchSize
+			if end > len(ids) {
+				end = len(ids)
+			}
+			if err = store.loadChunk(ctx, ids[start:end], entities, decodeErrs); err != nil {
+				return entities, err
+			}
+		}
+	} else {
+		if err = store.loadChunksConcurrently(ctx, ids, batchSize, entities, decodeErrs); err != nil {
+			return entities, err
+		}
+	}
+	if len(decodeErrs.Errors) > 0 {
+		return entities, decodeErrs
+	}
+	return entities, nil
+}
+
+//设置LoadAll每批查询的id数量以及最多同时进行的查询数，以更好地利用连接池。batchSize为0表示不分批
+func (store *MongodbStore[T]) SetLoadAllBatching(batchSize int, concurrency int) {
+	store.loadAllBatchSize = batchSize
+	store.loadAllConcurrency = concurrency
+}
+
+func (store *MongodbStore[T]) loadChunksConcurrently(ctx context.Context, ids []any, batchSize int, entities map[any]T, decodeErrs *DecodeErrors) error {
+	concurrency := store.loadAllConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, concurrency)
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(chunk []any) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			chunkEntities := make(map[any]T, len(chunk))
+			chunkErrs := &DecodeErrors{}
+			err := store.loadChunk(ctx, chunk, chunkEntities, chunkErrs)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				return
+			}
+			for id, entity := range chunkEntities {
+				entities[id] = entity
+			}
+			for id, decodeErr := range chunkErrs.Errors {
+				decodeErrs.add(id, decodeErr)
+			}
+		}(ids[start:end])
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (store *MongodbStore[T]) loadChunk(ctx context.Context, ids []any, entities map[any]T, decodeErrs *DecodeErrors) error {
+	idsByKey := make(map[string]any, len(ids))
+	marshaledIds := make([]any, 0, len(ids))
+	for _, id := range ids {
+		mid, err := store.marshalId(id)
+		if err != nil {
+			return err
+		}
+		key, err := idKey(mid)
+		if err != nil {
+			return err
+		}
+		idsByKey[key] = id
+		marshaledIds = append(marshaledIds, mid)
+	}
+	filter := bson.D{{store.idField, bson.D{{"$in", marshaledIds}}}}
+	cur, err := store.collection().Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		rawId := cur.Current.Lookup(store.idField)
+		id, ok := idsByKey[rawIdKey(rawId)]
+		if !ok {
+			id = rawIdValue(rawId)
+		}
+		entity, err := store.decode(ctx, cur.Current)
+		if err != nil {
+			decodeErrs.add(id, err)
+			continue
+		}
+		entities[id] = entity
+	}
+	return cur.Err()
+}
+
+func (store *MongodbStore[T]) decode(ctx context.Context, raw bson.Raw) (entity T, err error) {
+	if raw, err = store.resolveGridFSField(ctx, raw); err != nil {
+		return entity, err
+	}
+	entity = store.newZeroEntity()
+	if err = bson.UnmarshalWithRegistry(store.registry, raw, entity); err != nil {
+		return entity, err
+	}
+	return entity, nil
+}
+
+//用id的bson编码作为key，使得传入的id与数据库中读出的id可以对应上
+func idKey(id any) (string, error) {
+	if rawId, ok := id.(bson.RawValue); ok {
+		return rawIdKey(rawId), nil
+	}
+	t, data, err := bson.MarshalValue(id)
+	if err != nil {
+		return "", err
+	}
+	return string(append([]byte{byte(t)}, data...)), nil
+}
+
+func rawIdKey(rawId bson.RawValue) string {
+	return string(append([]byte{byte(rawId.Type)}, rawId.Value...))
+}
+
+//多个文档解码失败的汇总，key为文档id
+type DecodeErrors struct {
+	Errors map[any]error
+}
+
+func (e *DecodeErrors) add(id any, err error) {
+	if e.Errors == nil {
+		e.Errors = make(map[any]error)
+	}
+	e.Errors[id] = err
+}
+
+func (e *DecodeErrors) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for id, err := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%v: %v", id, err))
+	}
+	sort.Strings(msgs)
+	return fmt.Sprintf("%d document(s) failed to decode: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+//实体实现了Validator的话，Save和SaveAll在写入之前会先校验，校验不通过则返回错误且不写入
+type Validator interface {
+	Validate() error
+}
+
+func validateEntity(entity any) error {
+	if v, ok := entity.(Validator); ok {
+		return v.Validate()
+	}
+	return nil
+}
+
+//写入前的检查：校验实体，检查文档大小
+func (store *MongodbStore[T]) checkBeforeWrite(id any, entity any) error {
+	if err := validateEntity(entity); err != nil {
+		return err
+	}
+	return store.checkDocumentSize(id, entity)
+}
+
+func (store *MongodbStore[T]) Save(ctx context.Context, id any, entity T) (err error) {
+	ctx, span := store.startSpan(ctx, "Save")
+	defer func() { span.End(err) }()
+	if err := store.checkBeforeWrite(id, entity); err != nil {
+		return err
+	}
+	actor, err := store.auditActor(ctx)
+	if err != nil {
+		return err
+	}
+	doc, err := store.toDocument(ctx, entity)
+	if err != nil {
+		return err
+	}
+	newRef := store.gridFS.ref(doc)
+	if doc, err = store.stampInsert(doc, actor); err != nil {
+		store.deleteGridFSFile(ctx, newRef)
+		return err
+	}
+	if store.writeBuffer != nil {
+		return store.enqueue(ctx, mongo.NewInsertOneModel().SetDocument(doc))
+	}
+	_, err = store.collection().InsertOne(ctx, doc, options.InsertOne().SetBypassDocumentValidation(store.bypassValidation))
+	if err != nil {
+		store.deleteGridFSFile(ctx, newRef)
+	}
 	return err
 }
 
-func (store *MongodbStore[T]) SaveAll(ctx context.Context, entitiesToInsert map[any]any, entitiesToUpdate map[any]*arp.ProcessEntity) error {
-	toInsert := make([]any, 0, len(entitiesToInsert))
-	for _, v := range entitiesToInsert {
-		toInsert = append(toInsert, v)
+func (store *MongodbStore[T]) SaveAll(ctx context.Context, entitiesToInsert map[any]any, entitiesToUpdate map[any]*arp.ProcessEntity) (err error) {
+	ctx, span := store.startSpan(ctx, "SaveAll")
+	defer func() { span.End(err) }()
+	if len(entitiesToInsert) == 0 && len(entitiesToUpdate) == 0 {
+		return nil
+	}
+	//缓冲中可能有这次要更新的实体的插入，先写入，否则ReplaceOne匹配不到
+	if err = store.flush(ctx); err != nil {
+		return err
+	}
+	//先全部校验，有一个不通过就都不写
+	for k, v := range entitiesToInsert {
+		if err := store.checkBeforeWrite(k, v); err != nil {
+			return err
+		}
+	}
+	for k, v := range entitiesToUpdate {
+		if err := store.checkBeforeWrite(k, v.Entity()); err != nil {
+			return err
+		}
+	}
+	//按id排序后再写，使得不同进程写同一批文档的顺序一致
+	insertIds := make([]any, 0, len(entitiesToInsert))
+	for k := range entitiesToInsert {
+		insertIds = append(insertIds, k)
+	}
+	sortIds(insertIds)
+	updateIds := make([]any, 0, len(entitiesToUpdate))
+	for k := range entitiesToUpdate {
+		updateIds = append(updateIds, k)
+	}
+	sortIds(updateIds)
+	insertIds, insertFromUpdateIds, updateIds, err := store.dedupIds(insertIds, updateIds)
+	if err != nil {
+		return err
+	}
+	actor, err := store.auditActor(ctx)
+	if err != nil {
+		return err
+	}
+	insertEntities := make([]any, 0, len(insertIds)+len(insertFromUpdateIds))
+	for _, k := range insertIds {
+		insertEntities = append(insertEntities, entitiesToInsert[k])
+	}
+	for _, k := range insertFromUpdateIds {
+		insertEntities = append(insertEntities, entitiesToUpdate[k].Entity())
+	}
+	toInsert := make([]any, 0, len(insertEntities))
+	for _, entity := range insertEntities {
+		doc, err := store.toDocument(ctx, entity)
+		if err != nil {
+			store.discardGridFSFiles(ctx, toInsert)
+			return err
+		}
+		stamped, err := store.stampInsert(doc, actor)
+		if err != nil {
+			store.discardGridFSFiles(ctx, append(toInsert, doc))
+			return err
+		}
+		toInsert = append(toInsert, stamped)
 	}
 	if len(toInsert) > 0 {
-		_, err := store.coll.InsertMany(ctx, toInsert)
+		_, err := store.collection().InsertMany(ctx, toInsert, options.InsertMany().SetBypassDocumentValidation(store.bypassValidation))
 		if err != nil {
+			//有序插入在第一个失败的文档处停止，从它开始的文档都没有写入
+			var bwe mongo.BulkWriteException
+			if errors.As(err, &bwe) && len(bwe.WriteErrors) > 0 {
+				store.discardGridFSFiles(ctx, toInsert[bwe.WriteErrors[0].Index:])
+			}
 			return err
 		}
 	}
-	for k, v := range entitiesToUpdate {
-		filter := bson.D{{"_id", k}}
-		_, err := store.coll.ReplaceOne(ctx, filter, v.Entity())
+	if len(updateIds) == 0 {
+		return nil
+	}
+	for _, k := range updateIds {
+		filter, err := store.idFilter(k)
 		if err != nil {
 			return err
 		}
+		if _, err = store.replaceDocument(ctx, filter, entitiesToUpdate[k].Entity(), actor, options.Replace().SetBypassDocumentValidation(store.bypassValidation)); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (store *MongodbStore[T]) RemoveAll(ctx context.Context, ids []any) error {
-	for _, id := range ids {
-		filter := bson.D{{"_id", id}}
-		_, err := store.coll.DeleteOne(ctx, filter)
+func (store *MongodbStore[T]) RemoveAll(ctx context.Context, ids []any) (err error) {
+	ctx, span := store.startSpan(ctx, "RemoveAll")
+	defer func() { span.End(err) }()
+	_, _, err = store.removeAll(ctx, ids, false)
+	return err
+}
+
+//删除并返回删除的数量，以及不存在的id
+func (store *MongodbStore[T]) RemoveAllWithResult(ctx context.Context, ids []any) (deleted int64, notFound []any, err error) {
+	return store.removeAll(ctx, ids, true)
+}
+
+//按removeChunkSize分批用$in删除，避免一次删除的id太多导致命令超过大小限制，返回删除的总数。
+//findNotFound为true时，每批删除之前先查出存在的id，以得到不存在的id
+func (store *MongodbStore[T]) removeAll(ctx context.Context, ids []any, findNotFound bool) (deleted int64, notFound []any, err error) {
+	if err = store.flush(ctx); err != nil {
+		return 0, nil, err
+	}
+	chunkSize := store.removeChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultRemoveChunkSize
+	}
+	if findNotFound {
+		notFound = make([]any, 0)
+	}
+	for start := 0; start < len(ids); start += chunkSize {
+		end := start + chunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		marshaledIds := make([]any, 0, end-start)
+		for _, id := range ids[start:end] {
+			mid, err := store.marshalId(id)
+			if err != nil {
+				return deleted, notFound, err
+			}
+			marshaledIds = append(marshaledIds, mid)
+		}
+		filter := bson.D{{store.idField, bson.D{{"$in", marshaledIds}}}}
+		if findNotFound {
+			existing, err := store.existingIdKeys(ctx, filter)
+			if err != nil {
+				return deleted, notFound, err
+			}
+			for i, mid := range marshaledIds {
+				if key, _ := idKey(mid); !existing[key] {
+					notFound = append(notFound, ids[start+i])
+				}
+			}
+		}
+		oldRefs, err := store.gridFSRefs(ctx, filter)
 		if err != nil {
-			return err
+			return deleted, notFound, err
+		}
+		dr, err := store.collection().DeleteMany(ctx, filter)
+		if err != nil {
+			return deleted, notFound, err
+		}
+		deleted += dr.DeletedCount
+		for i := range oldRefs {
+			store.deleteGridFSFile(ctx, &oldRefs[i])
 		}
 	}
-	return nil
+	return deleted, notFound, nil
+}
+
+func (store *MongodbStore[T]) existingIdKeys(ctx context.Context, filter any) (map[string]bool, error) {
+	opts := options.Find().SetProjection(bson.D{{store.idField, 1}})
+	cursor, err := store.collection().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	existing := make(map[string]bool)
+	for cursor.Next(ctx) {
+		existing[rawIdKey(cursor.Current.Lookup(store.idField))] = true
+	}
+	return existing, cursor.Err()
+}
+
+const defaultRemoveChunkSize = 1000
+
+//设置RemoveAll每批删除的id数量，默认为1000
+func (store *MongodbStore[T]) SetRemoveChunkSize(removeChunkSize int) {
+	store.removeChunkSize = removeChunkSize
 }
 
 func NewMongodbStore[T any](coll *mongo.Collection, newZeroEntity arp.NewZeroEntity[T]) *MongodbStore[T] {
-	return &MongodbStore[T]{coll, newZeroEntity}
+	return &MongodbStore[T]{coll: coll, newZeroEntity: newZeroEntity, idField: defaultIdField, registry: bson.DefaultRegistry, maxDocSize: DefaultMaxDocumentSize}
+}
+
+//大字段存放到GridFS的store，见gridfs.go
+func NewMongodbStoreWithGridFS[T any](coll *mongo.Collection, newZeroEntity arp.NewZeroEntity[T], bucket *gridfs.Bucket, largeField string) *MongodbStore[T] {
+	store := NewMongodbStore(coll, newZeroEntity)
+	store.gridFS = &gridFSField{bucket, largeField}
+	return store
+}
+
+//每次操作都通过collProvider获取集合，客户端重连被替换之后，后续操作会自动使用新的客户端
+func NewMongodbStoreWithCollectionProvider[T any](collProvider func() *mongo.Collection, newZeroEntity arp.NewZeroEntity[T]) *MongodbStore[T] {
+	return &MongodbStore[T]{collProvider: collProvider, newZeroEntity: newZeroEntity, idField: defaultIdField, registry: bson.DefaultRegistry, maxDocSize: DefaultMaxDocumentSize}
 }
 
 type MongodbMutexes struct {
 	coll           *mongo.Collection
 	lockRetryCount int
 	maxLockTime    uint64
+	writeConcern   *writeconcern.WriteConcern
+	idGenerator    func() any
+	maxIdRetries   int
+	observer       MutexesObserver
+	clock          Clock
+	instanceId     string
+	tracer         Tracer
+	timeoutErr     bool
+}
+
+//锁使用的时钟，默认为系统时钟。测试时可以替换成可以手动拨动的时钟
+type Clock interface {
+	Now() time.Time
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+func (mutexes *MongodbMutexes) SetClock(clock Clock) {
+	mutexes.clock = clock
+}
+
+//最长上锁时间，超过这个时间没有释放的锁可以被其他人拿到
+func (mutexes *MongodbMutexes) MaxLockTime() time.Duration {
+	return time.Duration(mutexes.maxLockTime) * time.Millisecond
+}
+
+func (mutexes *MongodbMutexes) now() time.Time {
+	if mutexes.clock == nil {
+		return time.Now()
+	}
+	return mutexes.clock.Now()
+}
+
+func (mutexes *MongodbMutexes) nowMillis() uint64 {
+	return uint64(mutexes.now().UnixMilli())
+}
+
+//观察锁的事件
+type MutexesObserver interface {
+	//锁没有被释放，但因为超过了最长上锁时间而被其他人拿到（抢锁）。频繁出现说明可能有卡住的进程。
+	//previousLockTime为被抢的锁的上锁时间(毫秒)
+	LockStolen(id any, previousLockTime uint64)
+}
+
+func (mutexes *MongodbMutexes) SetObserver(observer MutexesObserver) {
+	mutexes.observer = observer
 }
 
 const defaultLockRetryCount = 300
 const defaultMaxLockTime = 1 * 60 * 1000
 
+var ErrLockTimeout = errors.New("lock retries exhausted")
+
+//开启后Lock重试次数用完仍没拿到锁时返回ErrLockTimeout（ok和absent仍然都是false），默认不开启，只返回ok为false
+func (mutexes *MongodbMutexes) SetLockTimeoutError(enable bool) {
+	mutexes.timeoutErr = enable
+}
+
 func (mutexes *MongodbMutexes) Lock(ctx context.Context, id any) (ok bool, absent bool, err error) {
-	currTime := uint64(time.Now().UnixMilli())
+	ctx, span := mutexes.startSpan(ctx, "Lock")
+	defer func() { span.End(err) }()
+	if waitObserver, isWaitObserver := mutexes.observer.(LockWaitObserver); isWaitObserver {
+		start := mutexes.now()
+		defer func() {
+			if (err == nil || err == ErrLockTimeout) && !absent {
+				waitObserver.LockWaited(id, mutexes.now().Sub(start), ok)
+			}
+		}()
+	}
+	currTime := mutexes.nowMillis()
 	unlockTime := currTime - mutexes.maxLockTime
 	tryOneOk, err := mutexes.tryLock(ctx, id, currTime, unlockTime)
 	if err != nil {
@@ -115,6 +678,9 @@ func (mutexes *MongodbMutexes) Lock(ctx context.Context, id any) (ok bool, absen
 		}
 		retryTimesLeft--
 	}
+	if mutexes.timeoutErr {
+		return false, false, ErrLockTimeout
+	}
 	return false, false, nil
 }
 
@@ -130,15 +696,23 @@ func (mutexes *MongodbMutexes) tryLock(ctx context.Context, id any, currTime uin
 			}},
 	}
 
-	update := bson.D{{"$set", bson.D{{"state", 1}, {"time", currTime}}}}
-	var updatedDocument bson.M
-	err = mutexes.coll.FindOneAndUpdate(ctx, filter, update).Decode(&updatedDocument)
+	update := bson.D{{"$set", bson.D{{"state", 1}, {"time", currTime}, {"owner", mutexes.instanceId}}}}
+	//返回的是更新之前的文档
+	var previous struct {
+		State int    `bson:"state"`
+		Time  uint64 `bson:"time"`
+	}
+	err = mutexes.coll.FindOneAndUpdate(ctx, filter, update).Decode(&previous)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return false, nil
 		}
 		return false, err
 	}
+	if previous.State == 1 && mutexes.observer != nil {
+		//之前的锁没有释放，是因为过期才拿到的锁
+		mutexes.observer.LockStolen(id, previous.Time)
+	}
 	return true, nil
 }
 
@@ -156,8 +730,8 @@ func (mutexes *MongodbMutexes) exists(ctx context.Context, id any) (yes bool, er
 }
 
 func (mutexes *MongodbMutexes) NewAndLock(ctx context.Context, id any) (ok bool, err error) {
-	currTime := uint64(time.Now().UnixMilli())
-	if _, err = mutexes.coll.InsertOne(ctx, bson.D{{"_id", id}, {"state", 1}, {"time", currTime}}); err != nil {
+	currTime := mutexes.nowMillis()
+	if _, err = mutexes.coll.InsertOne(ctx, bson.D{{"_id", id}, {"state", 1}, {"time", currTime}, {"owner", mutexes.instanceId}}); err != nil {
 		if mutexes.isDup(err) {
 			return false, nil
 		} else {
@@ -167,6 +741,29 @@ func (mutexes *MongodbMutexes) NewAndLock(ctx context.Context, id any) (ok bool,
 	return true, nil
 }
 
+//设置id生成器，NewAndLockWithGeneratedId遇到id冲突时会重新生成id，最多重试maxRetries次
+func (mutexes *MongodbMutexes) SetIdGenerator(idGenerator func() any, maxRetries int) {
+	mutexes.idGenerator = idGenerator
+	mutexes.maxIdRetries = maxRetries
+}
+
+//生成的id全部冲突时NewAndLockWithGeneratedId返回的错误
+var ErrIdRetriesExhausted = errors.New("generated ids all collided")
+
+//用id生成器生成的id创建并上锁，id冲突时换一个新id重试，重试maxRetries次仍然冲突则返回ErrIdRetriesExhausted
+func (mutexes *MongodbMutexes) NewAndLockWithGeneratedId(ctx context.Context) (id any, ok bool, err error) {
+	if mutexes.idGenerator == nil {
+		return nil, false, errors.New("id generator not configured")
+	}
+	for i := 0; i <= mutexes.maxIdRetries; i++ {
+		id = mutexes.idGenerator()
+		if ok, err = mutexes.NewAndLock(ctx, id); err != nil || ok {
+			return id, ok, err
+		}
+	}
+	return nil, false, ErrIdRetriesExhausted
+}
+
 func (mutexes *MongodbMutexes) isDup(err error) bool {
 	var e mongo.WriteException
 	if errors.As(err, &e) {
@@ -179,6 +776,47 @@ func (mutexes *MongodbMutexes) isDup(err error) bool {
 	return false
 }
 
+var ErrMutexNotFound = errors.New("mutex not found")
+
+//查看锁的当前状态，用于诊断。state为1表示上锁，lastTime为最后一次上锁的时间(毫秒)，held表示锁当前是否有效（上锁且未过期），
+//owner为最后一次上锁的实例id。锁不存在时返回ErrMutexNotFound
+func (mutexes *MongodbMutexes) LockInfo(ctx context.Context, id any) (state int, lastTime uint64, held bool, owner string, err error) {
+	filter := bson.D{{"_id", id}}
+	var doc struct {
+		State int    `bson:"state"`
+		Time  uint64 `bson:"time"`
+		Owner string `bson:"owner"`
+	}
+	err = mutexes.coll.FindOne(ctx, filter).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, 0, false, "", ErrMutexNotFound
+		}
+		return 0, 0, false, "", err
+	}
+	unlockTime := mutexes.nowMillis() - mutexes.maxLockTime
+	held = doc.State == 1 && doc.Time >= unlockTime
+	return doc.State, doc.Time, held, doc.Owner, nil
+}
+
+//默认的实例id：主机名+进程号
+func defaultInstanceId() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+//设置写入锁记录的实例id，用于排查锁被哪个实例持有，默认为主机名+进程号
+func (mutexes *MongodbMutexes) SetInstanceId(instanceId string) {
+	mutexes.instanceId = instanceId
+}
+
+func (mutexes *MongodbMutexes) InstanceId() string {
+	return mutexes.instanceId
+}
+
 func (mutexes *MongodbMutexes) UnlockAll(ctx context.Context, ids []any) {
 	for _, id := range ids {
 		filter := bson.D{{"_id", id}}
@@ -187,10 +825,84 @@ func (mutexes *MongodbMutexes) UnlockAll(ctx context.Context, ids []any) {
 	}
 }
 
+//检查锁集合可用：能连通，可写，且_id唯一索引能正常拒绝重复
+func (mutexes *MongodbMutexes) Verify(ctx context.Context) error {
+	collName := mutexes.coll.Database().Name() + "." + mutexes.coll.Name()
+	if err := mutexes.coll.Database().RunCommand(ctx, bson.D{{"ping", 1}}).Err(); err != nil {
+		return fmt.Errorf("mutexes collection %s is unreachable: %w", collName, err)
+	}
+	probeId := fmt.Sprintf("__arp_probe_%d", time.Now().UnixNano())
+	if _, err := mutexes.coll.InsertOne(ctx, bson.D{{"_id", probeId}, {"state", 0}, {"time", 0}}); err != nil {
+		return fmt.Errorf("mutexes collection %s is not writable: %w", collName, err)
+	}
+	defer mutexes.coll.DeleteOne(ctx, bson.D{{"_id", probeId}})
+	_, err := mutexes.coll.InsertOne(ctx, bson.D{{"_id", probeId}, {"state", 0}, {"time", 0}})
+	if err == nil {
+		return fmt.Errorf("mutexes collection %s does not reject duplicate _id", collName)
+	}
+	if !mutexes.isDup(err) {
+		return fmt.Errorf("mutexes collection %s unique _id check failed: %w", collName, err)
+	}
+	return nil
+}
+
 type MongodbRepository[T any] struct {
 	arp.Repository[T]
 	coll          *mongo.Collection
 	newZeroEntity arp.NewZeroEntity[T]
+	mutexes       arp.Mutexes
+	store         *MongodbStore[T]
+	maxResultSize int64
+}
+
+func (repo *MongodbRepository[T]) LoadRaw(ctx context.Context, id any) (entity T, raw bson.M, found bool, err error) {
+	if repo.store == nil {
+		return entity, nil, false, nil
+	}
+	return repo.store.LoadRaw(ctx, id)
+}
+
+//删除并返回删除的数量，以及不存在的id
+func (repo *MongodbRepository[T]) RemoveAllWithResult(ctx context.Context, ids []any) (deleted int64, notFound []any, err error) {
+	if repo.store == nil {
+		return 0, nil, nil
+	}
+	return repo.store.RemoveAllWithResult(ctx, ids)
+}
+
+//批量加载，见MongodbStore.LoadAll
+func (repo *MongodbRepository[T]) LoadAll(ctx context.Context, ids []any) (map[any]T, error) {
+	if repo.store == nil {
+		return nil, nil
+	}
+	return repo.store.LoadAll(ctx, ids)
+}
+
+//设置文档中存放id的字段名，默认为_id
+func (repo *MongodbRepository[T]) SetIdField(idField string) {
+	if repo.store == nil {
+		return
+	}
+	repo.store.SetIdField(idField)
+}
+
+//启动时检查实体集合和锁集合是否配置正确
+func (repo *MongodbRepository[T]) Verify(ctx context.Context) error {
+	if repo.coll == nil {
+		return nil
+	}
+	if err := repo.coll.Database().RunCommand(ctx, bson.D{{"ping", 1}}).Err(); err != nil {
+		return fmt.Errorf("collection %s.%s is unreachable: %w", repo.coll.Database().Name(), repo.coll.Name(), err)
+	}
+	mongodbMutexes, ok := repo.mutexes.(*MongodbMutexes)
+	if !ok {
+		return nil
+	}
+	if mongodbMutexes.coll.Database().Name() != repo.coll.Database().Name() {
+		return fmt.Errorf("mutexes collection is in database %s, but entities are in database %s",
+			mongodbMutexes.coll.Database().Name(), repo.coll.Database().Name())
+	}
+	return mongodbMutexes.Verify(ctx)
 }
 
 func (repo *MongodbRepository[T]) QueryAllIds(ctx context.Context) (ids []any, err error) {
@@ -202,25 +914,41 @@ func (repo *MongodbRepository[T]) QueryAllIds(ctx context.Context) (ids []any, e
 	if err != nil {
 		return nil, err
 	}
-	var results []bson.D
-	if err = cur.All(ctx, &results); err != nil {
-		return nil, err
-	}
+	defer cur.Close(ctx)
 
 	ids = make([]any, 0)
-	for result := range results {
-		var doc []byte
-		if doc, err = bson.Marshal(result); err != nil {
+	for cur.Next(ctx) {
+		entity, err := repo.decode(cur.Current)
+		if err != nil {
 			return nil, err
 		}
-		entity := repo.newZeroEntity()
-		bson.Unmarshal(doc, entity)
-		//约定第一个属性为id
-		ids = append(ids, reflect.ValueOf(entity).Elem().Field(0).Interface())
+		id, err := entityId(entity)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = cur.Err(); err != nil {
+		return nil, err
 	}
 	return ids, nil
 }
 
+//约定第一个属性为id。T是接口类型时，先取到背后的具体值再反射
+func entityId(entity any) (any, error) {
+	v := reflect.ValueOf(entity)
+	for v.Kind() == reflect.Interface || v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil, errors.New("entity is nil")
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct || v.NumField() == 0 || !v.Field(0).CanInterface() {
+		return nil, fmt.Errorf("can not get id from entity of type %s", v.Type())
+	}
+	return v.Field(0).Interface(), nil
+}
+
 func (repo *MongodbRepository[T]) Count(ctx context.Context) (uint64, error) {
 	if repo.coll == nil {
 		return 0, nil
@@ -229,49 +957,82 @@ func (repo *MongodbRepository[T]) Count(ctx context.Context) (uint64, error) {
 	return uint64(count), err
 }
 
+//查询成功时总是返回非nil的slice，没有匹配时长度为0。
+//个别文档解码失败时，其余的实体照常返回，同时返回*DecodeErrors列出解码失败的文档id
 func (repo *MongodbRepository[T]) QueryAllByField(ctx context.Context, fieldName string, fieldValue any) ([]T, error) {
 	if repo.coll == nil {
-		return nil, nil
+		return make([]T, 0), nil
 	}
 	filter := bson.D{{fieldName, fieldValue}}
-	cursor, err := repo.coll.Find(ctx, filter)
+	cursor, err := repo.coll.Find(ctx, filter, repo.limitResult(findOptions(ctx)))
 	if err != nil {
 		return nil, err
 	}
-	var results []bson.D
-	if err = cursor.All(ctx, &results); err != nil {
-		return nil, err
-	}
+	defer cursor.Close(ctx)
 	entities := make([]T, 0)
-	for _, result := range results {
-		var doc []byte
-		if doc, err = bson.Marshal(result); err != nil {
+	decodeErrs := &DecodeErrors{}
+	for cursor.Next(ctx) {
+		if err = repo.checkResultSize(len(entities) + len(decodeErrs.Errors) + 1); err != nil {
 			return nil, err
 		}
-		entity := repo.newZeroEntity()
-		bson.Unmarshal(doc, entity)
+		entity, err := repo.decode(cursor.Current)
+		if err != nil {
+			decodeErrs.add(rawIdValue(cursor.Current.Lookup(repo.store.idField)), err)
+			continue
+		}
 		entities = append(entities, entity)
 	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+	if len(decodeErrs.Errors) > 0 {
+		return entities, decodeErrs
+	}
 	return entities, nil
 }
 
 func NewMongodbMutexes(client *mongo.Client, database string, collection string) *MongodbMutexes {
-	return &MongodbMutexes{client.Database(database).Collection("mutexes_" + collection), defaultLockRetryCount, defaultMaxLockTime}
+	return &MongodbMutexes{coll: client.Database(database).Collection("mutexes_" + collection), lockRetryCount: defaultLockRetryCount, maxLockTime: defaultMaxLockTime, clock: wallClock{}, instanceId: defaultInstanceId()}
+}
+
+//使用指定的写关注创建锁。副本集部署时建议使用writeconcern.New(writeconcern.WMajority())，
+//这样上锁的写入在多数节点确认之后才返回，避免主从切换时锁的写入被回滚导致同时有两个持有者
+func NewMongodbMutexesWithWriteConcern(client *mongo.Client, database string, collection string, wc *writeconcern.WriteConcern) *MongodbMutexes {
+	coll := client.Database(database).Collection("mutexes_"+collection, options.Collection().SetWriteConcern(wc))
+	return &MongodbMutexes{coll: coll, lockRetryCount: defaultLockRetryCount, maxLockTime: defaultMaxLockTime, writeConcern: wc, clock: wallClock{}, instanceId: defaultInstanceId()}
+}
+
+//锁集合使用的写关注，nil表示使用客户端默认的写关注
+func (mutexes *MongodbMutexes) WriteConcern() *writeconcern.WriteConcern {
+	return mutexes.writeConcern
 }
 
 func NewMongodbRepository[T any](client *mongo.Client, database string, collection string, newZeroEntity arp.NewZeroEntity[T]) *MongodbRepository[T] {
 	if client == nil {
-		return &MongodbRepository[T]{arp.NewMockRepository[T](newZeroEntity), nil, newZeroEntity}
+		return &MongodbRepository[T]{Repository: arp.NewMockRepository[T](newZeroEntity), newZeroEntity: newZeroEntity}
 	}
 	mutexesimpl := NewMongodbMutexes(client, database, collection)
 	return NewMongodbRepositoryWithMutexesimpl(client, database, collection, newZeroEntity, mutexesimpl)
 }
 
+//Load带读缓存的仓库，见CachedStore。Take持有锁之后的加载总是读库，不会读到缓存的旧数据；
+//Find之类不上锁的读在多实例部署时可能读到其他实例修改之前的数据，最长为缓存的ttl，ttl为0时只适合单实例部署
+func NewMongodbRepositoryWithCache[T any](client *mongo.Client, database string, collection string, newZeroEntity arp.NewZeroEntity[T], cache EntityCache) *MongodbRepository[T] {
+	if client == nil {
+		return &MongodbRepository[T]{Repository: arp.NewMockRepository[T](newZeroEntity), newZeroEntity: newZeroEntity}
+	}
+	mutexesimpl := NewMongodbMutexes(client, database, collection)
+	coll := client.Database(database).Collection(collection)
+	store := NewMongodbStore(coll, newZeroEntity)
+	cachedStore := NewCachedStore[T](store, cache, newZeroEntity)
+	return &MongodbRepository[T]{Repository: arp.NewRepository[T](cachedStore, cachedStore.Mutexes(mutexesimpl), newZeroEntity), coll: coll, newZeroEntity: newZeroEntity, mutexes: mutexesimpl, store: store}
+}
+
 func NewMongodbRepositoryWithMutexesimpl[T any](client *mongo.Client, database string, collection string, newZeroEntity arp.NewZeroEntity[T], mutexesimpl arp.Mutexes) *MongodbRepository[T] {
 	if client == nil {
-		return &MongodbRepository[T]{arp.NewMockRepository[T](newZeroEntity), nil, newZeroEntity}
+		return &MongodbRepository[T]{Repository: arp.NewMockRepository[T](newZeroEntity), newZeroEntity: newZeroEntity}
 	}
 	coll := client.Database(database).Collection(collection)
 	store := NewMongodbStore(coll, newZeroEntity)
-	return &MongodbRepository[T]{arp.NewRepository[T](store, mutexesimpl, newZeroEntity), coll, newZeroEntity}
+	return &MongodbRepository[T]{Repository: arp.NewRepository[T](store, mutexesimpl, newZeroEntity), coll: coll, newZeroEntity: newZeroEntity, mutexes: mutexesimpl, store: store}
 }
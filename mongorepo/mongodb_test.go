@@ -0,0 +1,836 @@
+package mongorepo_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo/mutexestest"
+	"github.com/framework-arp/ARP4G/arp"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+type testDocument struct {
+	Id      string `bson:"_id"`
+	Content []byte `bson:"content"`
+}
+
+func TestNewAndLockWithGeneratedIdRetriesExhausted(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	mutexes := mongorepo.NewMongodbMutexes(client, testDatabase, testCollection(t, client))
+	if ok, err := mutexes.NewAndLock(ctx, "taken"); err != nil || !ok {
+		t.Fatalf("NewAndLock: ok=%v err=%v", ok, err)
+	}
+	generated := 0
+	mutexes.SetIdGenerator(func() any {
+		generated++
+		return "taken"
+	}, 2)
+	id, ok, err := mutexes.NewAndLockWithGeneratedId(ctx)
+	if !errors.Is(err, mongorepo.ErrIdRetriesExhausted) || ok || id != nil {
+		t.Fatalf("NewAndLockWithGeneratedId = %v, %v, %v, want ErrIdRetriesExhausted", id, ok, err)
+	}
+	if generated != 3 {
+		t.Fatalf("generated %d ids, want 3", generated)
+	}
+}
+
+func TestNewAndLockWithGeneratedIdRetriesCollision(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	mutexes := mongorepo.NewMongodbMutexes(client, testDatabase, testCollection(t, client))
+	if ok, err := mutexes.NewAndLock(ctx, "taken"); err != nil || !ok {
+		t.Fatalf("NewAndLock: ok=%v err=%v", ok, err)
+	}
+	//第一次生成的id已被占用，第二次生成新的id
+	ids := []any{"taken", "fresh"}
+	mutexes.SetIdGenerator(func() any {
+		id := ids[0]
+		ids = ids[1:]
+		return id
+	}, 3)
+	id, ok, err := mutexes.NewAndLockWithGeneratedId(ctx)
+	if err != nil || !ok || id != "fresh" {
+		t.Fatalf("NewAndLockWithGeneratedId = %v, %v, %v, want fresh", id, ok, err)
+	}
+	if _, _, held, _, err := mutexes.LockInfo(ctx, "fresh"); err != nil || !held {
+		t.Fatalf("LockInfo fresh: held=%v err=%v, want it held", held, err)
+	}
+}
+
+//使用新的锁集合和可以拨动的时钟
+func testMutexes(t testing.TB, client *mongo.Client) (*mongorepo.MongodbMutexes, *mutexestest.FakeClock) {
+	mutexes := mongorepo.NewMongodbMutexes(client, testDatabase, testCollection(t, client))
+	clock := mutexestest.NewFakeClock(time.UnixMilli(time.Now().UnixMilli()))
+	mutexes.SetClock(clock)
+	return mutexes, clock
+}
+
+func TestLockInfo(t *testing.T) {
+	ctx := context.Background()
+	mutexes, clock := testMutexes(t, testClient(t))
+	if _, _, _, _, err := mutexes.LockInfo(ctx, "x"); !errors.Is(err, mongorepo.ErrMutexNotFound) {
+		t.Fatalf("LockInfo absent: %v, want ErrMutexNotFound", err)
+	}
+	lockedAt := uint64(clock.Now().UnixMilli())
+	if ok, err := mutexes.NewAndLock(ctx, "x"); err != nil || !ok {
+		t.Fatalf("NewAndLock: ok=%v err=%v", ok, err)
+	}
+	check := func(step string, wantState int, wantTime uint64, wantHeld bool) {
+		t.Helper()
+		state, lastTime, held, owner, err := mutexes.LockInfo(ctx, "x")
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		if state != wantState || lastTime != wantTime || held != wantHeld || owner != mutexes.InstanceId() {
+			t.Fatalf("%s: state=%d lastTime=%d held=%v owner=%q, want %d %d %v %q", step, state, lastTime, held, owner, wantState, wantTime, wantHeld, mutexes.InstanceId())
+		}
+	}
+	check("after NewAndLock", 1, lockedAt, true)
+
+	mutexes.UnlockAll(ctx, []any{"x"})
+	check("after UnlockAll", 0, lockedAt, false)
+
+	clock.Advance(5 * time.Second)
+	relockedAt := uint64(clock.Now().UnixMilli())
+	if ok, _, err := mutexes.Lock(ctx, "x"); err != nil || !ok {
+		t.Fatalf("Lock: ok=%v err=%v", ok, err)
+	}
+	check("after Lock", 1, relockedAt, true)
+
+	//超过最长上锁时间没有释放，记录还是上锁状态，但已经不算持有
+	clock.Advance(mutexes.MaxLockTime() + time.Millisecond)
+	check("after MaxLockTime", 1, relockedAt, false)
+}
+
+func TestLockInfoReportsHolderInstance(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	collection := testCollection(t, client)
+	first := mongorepo.NewMongodbMutexes(client, testDatabase, collection)
+	first.SetInstanceId("worker-1")
+	second := mongorepo.NewMongodbMutexes(client, testDatabase, collection)
+	second.SetInstanceId("worker-2")
+	if ok, err := first.NewAndLock(ctx, "x"); err != nil || !ok {
+		t.Fatalf("NewAndLock: ok=%v err=%v", ok, err)
+	}
+	var stored bson.M
+	err := client.Database(testDatabase).Collection("mutexes_"+collection).FindOne(ctx, bson.D{{"_id", "x"}}).Decode(&stored)
+	if err != nil || stored["owner"] != "worker-1" {
+		t.Fatalf("stored owner = %v err=%v, want worker-1", stored["owner"], err)
+	}
+	if _, _, held, owner, err := second.LockInfo(ctx, "x"); err != nil || !held || owner != "worker-1" {
+		t.Fatalf("LockInfo = held %v owner %q err=%v, want held by worker-1", held, owner, err)
+	}
+	first.UnlockAll(ctx, []any{"x"})
+	if ok, _, err := second.Lock(ctx, "x"); err != nil || !ok {
+		t.Fatalf("Lock: ok=%v err=%v", ok, err)
+	}
+	if _, _, held, owner, err := first.LockInfo(ctx, "x"); err != nil || !held || owner != "worker-2" {
+		t.Fatalf("LockInfo = held %v owner %q err=%v, want held by worker-2", held, owner, err)
+	}
+}
+
+func TestDefaultInstanceIdHasPid(t *testing.T) {
+	mutexes := mongorepo.NewMongodbMutexes(offlineClient(t), testDatabase, "orders")
+	if id := mutexes.InstanceId(); !strings.HasSuffix(id, "-"+strconv.Itoa(os.Getpid())) {
+		t.Fatalf("InstanceId() = %q, want hostname-pid", id)
+	}
+}
+
+//记录LockStolen事件
+type stealRecorder struct {
+	mutex  sync.Mutex
+	stolen map[any]uint64
+}
+
+func (r *stealRecorder) LockStolen(id any, previousLockTime uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stolen[id] = previousLockTime
+}
+
+func TestLockStolenReported(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	collection := testCollection(t, client)
+	clock := mutexestest.NewFakeClock(time.UnixMilli(time.Now().UnixMilli()))
+	holder := mongorepo.NewMongodbMutexes(client, testDatabase, collection)
+	holder.SetClock(clock)
+	thief := mongorepo.NewMongodbMutexes(client, testDatabase, collection)
+	thief.SetClock(clock)
+	recorder := &stealRecorder{stolen: map[any]uint64{}}
+	thief.SetObserver(recorder)
+
+	lockedAt := uint64(clock.Now().UnixMilli())
+	for _, id := range []any{"stuck", "released"} {
+		if ok, err := holder.NewAndLock(ctx, id); err != nil || !ok {
+			t.Fatalf("NewAndLock %v: ok=%v err=%v", id, ok, err)
+		}
+	}
+	holder.UnlockAll(ctx, []any{"released"})
+	clock.Advance(thief.MaxLockTime() + time.Millisecond)
+	for _, id := range []any{"stuck", "released"} {
+		if ok, _, err := thief.Lock(ctx, id); err != nil || !ok {
+			t.Fatalf("Lock %v: ok=%v err=%v", id, ok, err)
+		}
+	}
+	//只有没释放、因为过期被拿到的锁算抢锁
+	if want := map[any]uint64{"stuck": lockedAt}; !reflect.DeepEqual(recorder.stolen, want) {
+		t.Fatalf("stolen = %v, want %v", recorder.stolen, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+
+	collection := testCollection(t, client)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, collection, newTestOrder)
+	if err := repo.Verify(ctx); err != nil {
+		t.Fatalf("Verify well configured: %v", err)
+	}
+
+	collection = testCollection(t, client)
+	otherDatabase := mongorepo.NewMongodbMutexes(client, testDatabase+"_other", collection)
+	repo = mongorepo.NewMongodbRepositoryWithMutexesimpl(client, testDatabase, collection, newTestOrder, otherDatabase)
+	if err := repo.Verify(ctx); err == nil || !strings.Contains(err.Error(), "database") {
+		t.Fatalf("Verify with mutexes in another database: %v", err)
+	}
+
+	//锁集合是一个视图，不能写入
+	collection = testCollection(t, client)
+	if err := client.Database(testDatabase).CreateView(ctx, "mutexes_"+collection, collection, mongo.Pipeline{}); err != nil {
+		t.Fatalf("CreateView: %v", err)
+	}
+	repo = mongorepo.NewMongodbRepository(client, testDatabase, collection, newTestOrder)
+	if err := repo.Verify(ctx); err == nil || !strings.Contains(err.Error(), "not writable") {
+		t.Fatalf("Verify with a read-only mutexes collection: %v", err)
+	}
+}
+
+func TestCustomIdField(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	collection := testCollection(t, client)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, collection, func() *orderByNo { return &orderByNo{} })
+	repo.SetIdField("orderNo")
+	err := arp.Go(ctx, func(ctx context.Context) error {
+		repo.Put(ctx, "n1", &orderByNo{"n1", "new"})
+		repo.Put(ctx, "n2", &orderByNo{"n2", "new"})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	err = arp.Go(ctx, func(ctx context.Context) error {
+		order, found := repo.Take(ctx, "n1")
+		if !found {
+			return errors.New("n1 not found by orderNo")
+		}
+		order.Status = "paid"
+		repo.Remove(ctx, "n2")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("update and remove: %v", err)
+	}
+	coll := client.Database(testDatabase).Collection(collection)
+	var stored orderByNo
+	if err = coll.FindOne(ctx, bson.D{{"orderNo", "n1"}}).Decode(&stored); err != nil || stored.Status != "paid" {
+		t.Fatalf("stored n1 = %+v err=%v, want paid", stored, err)
+	}
+	if count, _ := coll.CountDocuments(ctx, bson.D{}); count != 1 {
+		t.Fatalf("count = %d, want 1 after removing n2", count)
+	}
+	loaded, err := repo.LoadAll(ctx, []any{"n1", "n2"})
+	if err != nil || len(loaded) != 1 || loaded["n1"].Status != "paid" {
+		t.Fatalf("LoadAll = %v err=%v", loaded, err)
+	}
+}
+
+func TestLoadAllReturnsPartialResultsWithDecodeErrors(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	coll := client.Database(testDatabase).Collection(testCollection(t, client))
+	_, err := coll.InsertMany(ctx, []any{
+		bson.D{{"_id", "a"}, {"status", "new"}, {"qty", 1}},
+		bson.D{{"_id", "b"}, {"status", "new"}, {"qty", 2}},
+		bson.D{{"_id", "c"}, {"status", "new"}, {"qty", "not a number"}},
+	})
+	if err != nil {
+		t.Fatalf("InsertMany: %v", err)
+	}
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	entities, err := store.LoadAll(ctx, []any{"a", "b", "c", "absent"})
+	var decodeErrs *mongorepo.DecodeErrors
+	if !errors.As(err, &decodeErrs) {
+		t.Fatalf("LoadAll err = %v, want *DecodeErrors", err)
+	}
+	if len(decodeErrs.Errors) != 1 || decodeErrs.Errors["c"] == nil {
+		t.Fatalf("decode errors = %v, want only c", decodeErrs.Errors)
+	}
+	if len(entities) != 2 || entities["a"].Qty != 1 || entities["b"].Qty != 2 {
+		t.Fatalf("entities = %v, want a and b", entities)
+	}
+}
+
+func TestSaveAllEmptyDoesNotTouchDatabase(t *testing.T) {
+	//没有集合，返回nil说明没有访问数据库
+	store := mongorepo.NewMongodbStore[*testOrder](nil, newTestOrder)
+	if err := store.SaveAll(context.Background(), map[any]any{}, map[any]*arp.ProcessEntity{}); err != nil {
+		t.Fatalf("SaveAll empty: %v", err)
+	}
+}
+
+func BenchmarkSaveAllEmpty(b *testing.B) {
+	ctx := context.Background()
+	store := mongorepo.NewMongodbStore[*testOrder](nil, newTestOrder)
+	inserts, updates := map[any]any{}, map[any]*arp.ProcessEntity{}
+	for i := 0; i < b.N; i++ {
+		store.SaveAll(ctx, inserts, updates)
+	}
+}
+
+func TestSaveAllInsertOnly(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	coll := client.Database(testDatabase).Collection(testCollection(t, client))
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	err := store.SaveAll(ctx, map[any]any{"a": &testOrder{"a", "new", 1}, "b": &testOrder{"b", "new", 2}}, nil)
+	if err != nil {
+		t.Fatalf("SaveAll: %v", err)
+	}
+	if count, _ := coll.CountDocuments(ctx, bson.D{}); count != 2 {
+		t.Fatalf("count = %d, want 2", count)
+	}
+}
+
+func BenchmarkSaveAllInsertOnly(b *testing.B) {
+	ctx := context.Background()
+	client := testClient(b)
+	coll := client.Database(testDatabase).Collection(testCollection(b, client))
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id := primitive.NewObjectID().Hex()
+		if err := store.SaveAll(ctx, map[any]any{id: &testOrder{id, "new", i}}, nil); err != nil {
+			b.Fatalf("SaveAll: %v", err)
+		}
+	}
+}
+
+//记录发给某个集合的insert和update命令中的id顺序
+type writeOrderRecorder struct {
+	mutex      sync.Mutex
+	collection string
+	inserted   []string
+	updated    []string
+}
+
+func (r *writeOrderRecorder) monitor() *event.CommandMonitor {
+	return &event.CommandMonitor{Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		switch e.CommandName {
+		case "insert":
+			if e.Command.Lookup("insert").StringValue() != r.collection {
+				return
+			}
+			docs, _ := e.Command.Lookup("documents").Array().Values()
+			for _, doc := range docs {
+				r.inserted = append(r.inserted, doc.Document().Lookup("_id").StringValue())
+			}
+		case "update":
+			if e.Command.Lookup("update").StringValue() != r.collection {
+				return
+			}
+			updates, _ := e.Command.Lookup("updates").Array().Values()
+			for _, update := range updates {
+				r.updated = append(r.updated, update.Document().Lookup("q", "_id").StringValue())
+			}
+		}
+	}}
+}
+
+func TestSaveAllWritesInSortedIdOrder(t *testing.T) {
+	ctx := context.Background()
+	recorder := &writeOrderRecorder{}
+	client := testClient(t, options.Client().SetMonitor(recorder.monitor()))
+	recorder.collection = testCollection(t, client)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, recorder.collection, newTestOrder)
+	ids := []string{"c", "e", "a", "d", "b"}
+	err := arp.Go(ctx, func(ctx context.Context) error {
+		for _, id := range ids {
+			repo.Put(ctx, id, &testOrder{id, "new", 1})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	err = arp.Go(ctx, func(ctx context.Context) error {
+		for _, id := range ids {
+			order, _ := repo.Take(ctx, id)
+			order.Qty = 2
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if !sort.StringsAreSorted(recorder.inserted) || len(recorder.inserted) != len(ids) {
+		t.Fatalf("insert order = %v, want sorted", recorder.inserted)
+	}
+	if !sort.StringsAreSorted(recorder.updated) || len(recorder.updated) != len(ids) {
+		t.Fatalf("update order = %v, want sorted", recorder.updated)
+	}
+}
+
+func TestNewMongodbMutexesWithWriteConcern(t *testing.T) {
+	ctx := context.Background()
+	var mutex sync.Mutex
+	var mutexesColl string
+	writeConcerns := make(map[string]string)
+	monitor := &event.CommandMonitor{Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+		if e.CommandName != "insert" && e.CommandName != "update" {
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if e.Command.Lookup(e.CommandName).StringValue() != mutexesColl {
+			return
+		}
+		w, _ := e.Command.Lookup("writeConcern", "w").StringValueOK()
+		writeConcerns[e.CommandName] = w
+	}}
+	client := testClient(t, options.Client().SetMonitor(monitor))
+	collection := testCollection(t, client)
+	mutex.Lock()
+	mutexesColl = "mutexes_" + collection
+	mutex.Unlock()
+	mutexes := mongorepo.NewMongodbMutexesWithWriteConcern(client, testDatabase, collection, writeconcern.New(writeconcern.WMajority()))
+	if w := mutexes.WriteConcern(); w == nil || w.GetW() != "majority" {
+		t.Fatalf("WriteConcern() = %v, want majority", w)
+	}
+	if ok, err := mutexes.NewAndLock(ctx, "x"); err != nil || !ok {
+		t.Fatalf("NewAndLock: ok=%v err=%v", ok, err)
+	}
+	mutexes.UnlockAll(ctx, []any{"x"})
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, name := range []string{"insert", "update"} {
+		if writeConcerns[name] != "majority" {
+			t.Fatalf("%s on the mutexes collection used writeConcern w=%q, want majority", name, writeConcerns[name])
+		}
+	}
+}
+
+//编码成"P-0001"这样字符串的自定义id
+type orderCode struct {
+	Prefix string
+	Seq    int
+}
+
+type codedOrder struct {
+	Code   orderCode `bson:"_id"`
+	Status string    `bson:"status"`
+}
+
+func orderCodeRegistry() *bsoncodec.Registry {
+	codeType := reflect.TypeOf(orderCode{})
+	encode := func(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+		code := val.Interface().(orderCode)
+		return vw.WriteString(fmt.Sprintf("%s-%04d", code.Prefix, code.Seq))
+	}
+	decode := func(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+		s, err := vr.ReadString()
+		if err != nil {
+			return err
+		}
+		prefix, seq, _ := strings.Cut(s, "-")
+		n, err := strconv.Atoi(seq)
+		if err != nil {
+			return err
+		}
+		val.Set(reflect.ValueOf(orderCode{prefix, n}))
+		return nil
+	}
+	return bson.NewRegistryBuilder().
+		RegisterTypeEncoder(codeType, bsoncodec.ValueEncoderFunc(encode)).
+		RegisterTypeDecoder(codeType, bsoncodec.ValueDecoderFunc(decode)).
+		Build()
+}
+
+func TestCustomIdTypeRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	coll := client.Database(testDatabase).Collection(testCollection(t, client))
+	store := mongorepo.NewMongodbStore(coll, func() *codedOrder { return &codedOrder{} })
+	if err := store.SetRegistry(orderCodeRegistry()); err != nil {
+		t.Fatalf("SetRegistry: %v", err)
+	}
+	code := orderCode{"P", 1}
+	if err := store.Save(ctx, code, &codedOrder{code, "new"}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if count, _ := coll.CountDocuments(ctx, bson.D{{"_id", "P-0001"}}); count != 1 {
+		t.Fatalf("document with _id P-0001 not found, the id was not encoded through the registry")
+	}
+	order, found, err := store.Load(ctx, code)
+	if err != nil || !found || order.Code != code {
+		t.Fatalf("Load = %+v found=%v err=%v", order, found, err)
+	}
+	loaded, err := store.LoadAll(ctx, []any{code, orderCode{"P", 2}})
+	if err != nil || len(loaded) != 1 || loaded[code] == nil {
+		t.Fatalf("LoadAll = %v err=%v, want the entity under the caller's id", loaded, err)
+	}
+	if err = store.RemoveAll(ctx, []any{code}); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	if _, found, err = store.Load(ctx, code); err != nil || found {
+		t.Fatalf("Load after RemoveAll: found=%v err=%v", found, err)
+	}
+}
+
+type validatedOrder struct {
+	Id  string `bson:"_id"`
+	Qty int    `bson:"qty"`
+}
+
+var errNegativeQty = errors.New("qty must not be negative")
+
+func (order *validatedOrder) Validate() error {
+	if order.Qty < 0 {
+		return errNegativeQty
+	}
+	return nil
+}
+
+func TestValidatorRejectsInvalidEntitiesWithoutWriting(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	coll := client.Database(testDatabase).Collection(testCollection(t, client))
+	store := mongorepo.NewMongodbStore(coll, func() *validatedOrder { return &validatedOrder{} })
+	if err := store.Save(ctx, "bad", &validatedOrder{"bad", -1}); !errors.Is(err, errNegativeQty) {
+		t.Fatalf("Save invalid: %v, want the validation error", err)
+	}
+	//一批中有一个不合法，整批都不写
+	inserts := map[any]any{"good": &validatedOrder{"good", 1}, "bad": &validatedOrder{"bad", -1}}
+	if err := store.SaveAll(ctx, inserts, nil); !errors.Is(err, errNegativeQty) {
+		t.Fatalf("SaveAll with an invalid entity: %v, want the validation error", err)
+	}
+	if count, _ := coll.CountDocuments(ctx, bson.D{}); count != 0 {
+		t.Fatalf("%d documents written, want none", count)
+	}
+}
+
+func TestQueryAllByFieldWithoutMatches(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, testCollection(t, client), newTestOrder)
+	repo.InsertIfAbsent(ctx, "o1", &testOrder{"o1", "paid", 1})
+	orders, err := repo.QueryAllByField(ctx, "status", "new")
+	if err != nil || orders == nil || len(orders) != 0 {
+		t.Fatalf("QueryAllByField = %v err=%v, want an empty non-nil slice", orders, err)
+	}
+}
+
+func TestQueryAllByFieldWithoutClient(t *testing.T) {
+	repo := mongorepo.NewMongodbRepository(nil, testDatabase, "orders", newTestOrder)
+	orders, err := repo.QueryAllByField(context.Background(), "status", "new")
+	if err != nil || orders == nil || len(orders) != 0 {
+		t.Fatalf("QueryAllByField = %v err=%v, want an empty non-nil slice", orders, err)
+	}
+}
+
+func TestCollectionProviderFollowsClientReplacement(t *testing.T) {
+	ctx := context.Background()
+	oldClient := testClient(t)
+	newClient := testClient(t)
+	collection := testCollection(t, newClient)
+	var current atomic.Value
+	current.Store(oldClient)
+	store := mongorepo.NewMongodbStoreWithCollectionProvider(func() *mongo.Collection {
+		return current.Load().(*mongo.Client).Database(testDatabase).Collection(collection)
+	}, newTestOrder)
+	if err := store.Save(ctx, "o1", &testOrder{"o1", "new", 1}); err != nil {
+		t.Fatalf("Save with the old client: %v", err)
+	}
+	//替换客户端并断开旧客户端，之后的操作只有用新客户端才能成功
+	current.Store(newClient)
+	if err := oldClient.Disconnect(ctx); err != nil {
+		t.Fatalf("Disconnect: %v", err)
+	}
+	if err := store.Save(ctx, "o2", &testOrder{"o2", "new", 2}); err != nil {
+		t.Fatalf("Save after the swap: %v", err)
+	}
+	for _, id := range []string{"o1", "o2"} {
+		if _, found, err := store.Load(ctx, id); err != nil || !found {
+			t.Fatalf("Load %s after the swap: found=%v err=%v", id, found, err)
+		}
+	}
+}
+
+func TestLoadRawKeepsFieldsOutsideTheEntity(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	coll := client.Database(testDatabase).Collection(testCollection(t, client))
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	if _, err := coll.InsertOne(ctx, bson.D{{"_id", "o1"}, {"status", "new"}, {"qty", 2}, {"note", "from v2"}}); err != nil {
+		t.Fatalf("InsertOne: %v", err)
+	}
+	order, raw, found, err := store.LoadRaw(ctx, "o1")
+	if err != nil || !found {
+		t.Fatalf("LoadRaw: found=%v err=%v", found, err)
+	}
+	if raw["note"] != "from v2" {
+		t.Fatalf("raw note = %v, want from v2", raw["note"])
+	}
+	if *order != (testOrder{"o1", "new", 2}) {
+		t.Fatalf("entity = %+v", order)
+	}
+	//实体上没有note字段，再编码也不会带上它
+	doc, _ := bson.Marshal(order)
+	if _, err = bson.Raw(doc).LookupErr("note"); err == nil {
+		t.Fatalf("entity carries the note field")
+	}
+}
+
+func TestRemoveAllInChunks(t *testing.T) {
+	ctx := context.Background()
+	var collection string
+	var deletes int32
+	monitor := &event.CommandMonitor{Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+		if e.CommandName == "delete" && e.Command.Lookup("delete").StringValue() == collection {
+			atomic.AddInt32(&deletes, 1)
+		}
+	}}
+	client := testClient(t, options.Client().SetMonitor(monitor))
+	collection = testCollection(t, client)
+	coll := client.Database(testDatabase).Collection(collection)
+	const count = 50000
+	docs := make([]any, 0, count)
+	ids := make([]any, 0, count)
+	for i := 0; i < count; i++ {
+		id := fmt.Sprintf("o%05d", i)
+		docs = append(docs, bson.D{{"_id", id}})
+		ids = append(ids, id)
+	}
+	if _, err := coll.InsertMany(ctx, docs); err != nil {
+		t.Fatalf("InsertMany: %v", err)
+	}
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	store.SetRemoveChunkSize(5000)
+	if err := store.RemoveAll(ctx, ids); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	if left, _ := coll.CountDocuments(ctx, bson.D{}); left != 0 {
+		t.Fatalf("%d documents left, want all removed", left)
+	}
+	if n := atomic.LoadInt32(&deletes); n != count/5000 {
+		t.Fatalf("%d delete commands, want %d chunks", n, count/5000)
+	}
+}
+
+type shipment interface {
+	ShipmentId() string
+}
+
+type parcel struct {
+	Id     string `bson:"_id"`
+	Weight int    `bson:"weight"`
+}
+
+func (p *parcel) ShipmentId() string {
+	return p.Id
+}
+
+func TestQueryAllIdsWithInterfaceEntity(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	collection := testCollection(t, client)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, collection, func() shipment { return &parcel{} })
+	coll := client.Database(testDatabase).Collection(collection)
+	if _, err := coll.InsertMany(ctx, []any{&parcel{"p2", 3}, &parcel{"p1", 5}}); err != nil {
+		t.Fatalf("InsertMany: %v", err)
+	}
+	ids, err := repo.QueryAllIds(ctx)
+	if err != nil {
+		t.Fatalf("QueryAllIds: %v", err)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].(string) < ids[j].(string) })
+	if !reflect.DeepEqual(ids, []any{"p1", "p2"}) {
+		t.Fatalf("QueryAllIds = %v, want [p1 p2]", ids)
+	}
+	shipments, err := repo.QueryAllByField(ctx, "weight", 5)
+	if err != nil || len(shipments) != 1 || shipments[0].ShipmentId() != "p1" {
+		t.Fatalf("QueryAllByField = %v err=%v, want p1", shipments, err)
+	}
+}
+
+func TestRemoveAllWithResult(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	coll := client.Database(testDatabase).Collection(testCollection(t, client))
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	//每批2个id，不存在的id分布在不同的批次里
+	store.SetRemoveChunkSize(2)
+	if err := store.SaveAll(ctx, map[any]any{"a": &testOrder{"a", "new", 1}, "c": &testOrder{"c", "new", 1}, "d": &testOrder{"d", "new", 1}}, nil); err != nil {
+		t.Fatalf("SaveAll: %v", err)
+	}
+	deleted, notFound, err := store.RemoveAllWithResult(ctx, []any{"a", "b", "c", "d", "e"})
+	if err != nil {
+		t.Fatalf("RemoveAllWithResult: %v", err)
+	}
+	if deleted != 3 || !reflect.DeepEqual(notFound, []any{"b", "e"}) {
+		t.Fatalf("RemoveAllWithResult = %d %v, want 3 [b e]", deleted, notFound)
+	}
+	deleted, notFound, err = store.RemoveAllWithResult(ctx, []any{"a"})
+	if err != nil || deleted != 0 || !reflect.DeepEqual(notFound, []any{"a"}) {
+		t.Fatalf("RemoveAllWithResult again = %d %v err=%v, want 0 [a]", deleted, notFound, err)
+	}
+}
+
+func TestLoadAllInConcurrentBatches(t *testing.T) {
+	ctx := context.Background()
+	var collection string
+	var finds int32
+	monitor := &event.CommandMonitor{Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+		if e.CommandName == "find" && e.Command.Lookup("find").StringValue() == collection {
+			atomic.AddInt32(&finds, 1)
+		}
+	}}
+	client := testClient(t, options.Client().SetMonitor(monitor))
+	collection = testCollection(t, client)
+	coll := client.Database(testDatabase).Collection(collection)
+	const count = 20000
+	docs := make([]any, 0, count)
+	ids := make([]any, 0, count+1)
+	for i := 0; i < count; i++ {
+		id := fmt.Sprintf("o%05d", i)
+		docs = append(docs, &testOrder{id, "new", i})
+		ids = append(ids, id)
+	}
+	if _, err := coll.InsertMany(ctx, docs); err != nil {
+		t.Fatalf("InsertMany: %v", err)
+	}
+	ids = append(ids, "absent")
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	store.SetLoadAllBatching(1000, 4)
+	loaded, err := store.LoadAll(ctx, ids)
+	if err != nil {
+		t.Fatalf("LoadAll: %v", err)
+	}
+	if len(loaded) != count {
+		t.Fatalf("loaded %d entities, want %d", len(loaded), count)
+	}
+	for i := 0; i < count; i++ {
+		id := fmt.Sprintf("o%05d", i)
+		if order := loaded[id]; order == nil || order.Id != id || order.Qty != i {
+			t.Fatalf("loaded[%s] = %+v", id, order)
+		}
+	}
+	//20001个id，每批1000个
+	if n := atomic.LoadInt32(&finds); n != 21 {
+		t.Fatalf("%d find commands, want 21 batches", n)
+	}
+}
+
+func TestBypassDocumentValidation(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	collection := testCollection(t, client)
+	db := client.Database(testDatabase)
+	//库里的校验规则要求qty不小于0
+	validator := bson.D{{"$jsonSchema", bson.D{{"properties", bson.D{{"qty", bson.D{{"minimum", 0}}}}}}}}
+	if err := db.CreateCollection(ctx, collection, options.CreateCollection().SetValidator(validator)); err != nil {
+		t.Fatalf("CreateCollection: %v", err)
+	}
+	coll := db.Collection(collection)
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	invalid := map[any]any{"a": &testOrder{"a", "new", -1}, "b": &testOrder{"b", "new", -2}}
+	//121为DocumentValidationFailure
+	var serverErr mongo.ServerError
+	if err := store.SaveAll(ctx, invalid, nil); !errors.As(err, &serverErr) || !serverErr.HasErrorCode(121) {
+		t.Fatalf("SaveAll without bypass: %v, want a validation error", err)
+	}
+	if count, _ := coll.CountDocuments(ctx, bson.D{}); count != 0 {
+		t.Fatalf("%d documents written without bypass, want none", count)
+	}
+	store.SetBypassDocumentValidation(true)
+	if err := store.SaveAll(ctx, invalid, nil); err != nil {
+		t.Fatalf("SaveAll with bypass: %v", err)
+	}
+	if count, _ := coll.CountDocuments(ctx, bson.D{}); count != 2 {
+		t.Fatalf("%d documents written with bypass, want 2", count)
+	}
+}
+
+func TestQueryAllByFieldReturnsPartialResultsWithDecodeErrors(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	collection := testCollection(t, client)
+	docs := make([]any, 0, 20)
+	for i := 0; i < 20; i++ {
+		docs = append(docs, bson.D{{"_id", fmt.Sprintf("o%02d", i)}, {"status", "new"}, {"qty", i}})
+	}
+	//qty的类型变了，无法解码
+	docs[7] = bson.D{{"_id", "o07"}, {"status", "new"}, {"qty", "seven"}}
+	if _, err := client.Database(testDatabase).Collection(collection).InsertMany(ctx, docs); err != nil {
+		t.Fatalf("InsertMany: %v", err)
+	}
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, collection, newTestOrder)
+	orders, err := repo.QueryAllByField(ctx, "status", "new")
+	var decodeErrs *mongorepo.DecodeErrors
+	if !errors.As(err, &decodeErrs) {
+		t.Fatalf("QueryAllByField err = %v, want *DecodeErrors", err)
+	}
+	if len(decodeErrs.Errors) != 1 || decodeErrs.Errors["o07"] == nil {
+		t.Fatalf("decode errors = %v, want only o07", decodeErrs.Errors)
+	}
+	if len(orders) != 19 {
+		t.Fatalf("%d orders returned, want the other 19", len(orders))
+	}
+	for _, order := range orders {
+		if order.Id == "o07" || order.Id != fmt.Sprintf("o%02d", order.Qty) {
+			t.Fatalf("unexpected order %+v", order)
+		}
+	}
+}
+
+func TestLockTimeoutError(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	mutexes := mongorepo.NewMongodbMutexes(client, testDatabase, testCollection(t, client))
+	if ok, err := mutexes.NewAndLock(ctx, "x"); err != nil || !ok {
+		t.Fatalf("NewAndLock: ok=%v err=%v", ok, err)
+	}
+	if ok, absent, err := mutexes.Lock(ctx, "x"); err != nil || ok || absent {
+		t.Fatalf("Lock without timeout error: ok=%v absent=%v err=%v", ok, absent, err)
+	}
+	mutexes.SetLockTimeoutError(true)
+	ok, absent, err := mutexes.Lock(ctx, "x")
+	if !errors.Is(err, mongorepo.ErrLockTimeout) || ok || absent {
+		t.Fatalf("Lock with timeout error: ok=%v absent=%v err=%v", ok, absent, err)
+	}
+}
@@ -0,0 +1,12 @@
+package mongorepo_test
+
+import (
+	"testing"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo/mutexestest"
+)
+
+func TestMongodbMutexesConformance(t *testing.T) {
+	client := testClient(t)
+	mutexestest.RunMutexesConformance(t, mutexestest.MongodbMutexesFactory(client, testDatabase))
+}
@@ -0,0 +1,196 @@
+//锁实现的一致性测试。替换MongodbMutexes的锁实现（例如基于Redis的实现）都应该通过这套测试，
+//以保证和MongodbMutexes有相同的行为。在实现的_test.go中调用：
+//
+//	func TestMutexesConformance(t *testing.T) {
+//		mutexestest.RunMutexesConformance(t, func(t *testing.T) arp.Mutexes { return newMyMutexes(t) })
+//	}
+package mutexestest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+	"github.com/framework-arp/ARP4G/arp"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+//为每个子测试创建一个全新的（没有任何锁的）锁实现
+type Factory func(t *testing.T) arp.Mutexes
+
+//可以过期的锁实现（例如MongodbMutexes）会额外测试过期之后锁可以被拿到
+type expirable interface {
+	SetClock(clock mongorepo.Clock)
+	MaxLockTime() time.Duration
+}
+
+//等待一个可能阻塞的Lock调用的时间
+const contentionWait = 200 * time.Millisecond
+
+func RunMutexesConformance(t *testing.T, factory Factory) {
+	ctx := context.Background()
+
+	t.Run("LockAbsent", func(t *testing.T) {
+		mutexes := factory(t)
+		ok, absent, err := mutexes.Lock(ctx, "absent")
+		if err != nil {
+			t.Fatalf("Lock: %v", err)
+		}
+		if ok || !absent {
+			t.Fatalf("Lock on absent id: got ok=%v absent=%v, want ok=false absent=true", ok, absent)
+		}
+	})
+
+	t.Run("NewAndLock", func(t *testing.T) {
+		mutexes := factory(t)
+		ok, err := mutexes.NewAndLock(ctx, "new")
+		if err != nil {
+			t.Fatalf("NewAndLock: %v", err)
+		}
+		if !ok {
+			t.Fatalf("first NewAndLock: got ok=false, want true")
+		}
+		ok, err = mutexes.NewAndLock(ctx, "new")
+		if err != nil {
+			t.Fatalf("NewAndLock: %v", err)
+		}
+		if ok {
+			t.Fatalf("second NewAndLock: got ok=true, want false")
+		}
+		mutexes.UnlockAll(ctx, []any{"new"})
+	})
+
+	t.Run("UnlockThenLock", func(t *testing.T) {
+		mutexes := factory(t)
+		mustNewAndLock(t, mutexes, "id")
+		mutexes.UnlockAll(ctx, []any{"id"})
+		ok, absent, err := mutexes.Lock(ctx, "id")
+		if err != nil {
+			t.Fatalf("Lock: %v", err)
+		}
+		if !ok || absent {
+			t.Fatalf("Lock after unlock: got ok=%v absent=%v, want ok=true absent=false", ok, absent)
+		}
+		mutexes.UnlockAll(ctx, []any{"id"})
+	})
+
+	t.Run("Contention", func(t *testing.T) {
+		mutexes := factory(t)
+		mustNewAndLock(t, mutexes, "id")
+		result := lockAsync(ctx, mutexes, "id")
+		select {
+		case r := <-result:
+			if r.err != nil {
+				t.Fatalf("Lock: %v", r.err)
+			}
+			if r.ok {
+				t.Fatalf("Lock on held id: got ok=true, want false or blocking")
+			}
+			mutexes.UnlockAll(ctx, []any{"id"})
+		case <-time.After(contentionWait):
+			//阻塞式的实现，释放之后应该拿到锁
+			mutexes.UnlockAll(ctx, []any{"id"})
+			r := <-result
+			if r.err != nil || !r.ok {
+				t.Fatalf("blocked Lock after unlock: got ok=%v err=%v, want ok=true", r.ok, r.err)
+			}
+			mutexes.UnlockAll(ctx, []any{"id"})
+		}
+	})
+
+	t.Run("UnlockAllMultiple", func(t *testing.T) {
+		mutexes := factory(t)
+		ids := []any{"a", "b", "c"}
+		for _, id := range ids {
+			mustNewAndLock(t, mutexes, id)
+		}
+		mutexes.UnlockAll(ctx, ids)
+		for _, id := range ids {
+			ok, _, err := mutexes.Lock(ctx, id)
+			if err != nil || !ok {
+				t.Fatalf("Lock %v after UnlockAll: got ok=%v err=%v, want ok=true", id, ok, err)
+			}
+		}
+		mutexes.UnlockAll(ctx, ids)
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		mutexes := factory(t)
+		exp, ok := mutexes.(expirable)
+		if !ok {
+			t.Skip("mutexes do not expire")
+		}
+		clock := NewFakeClock(time.Now())
+		exp.SetClock(clock)
+		mustNewAndLock(t, mutexes, "id")
+		clock.Advance(exp.MaxLockTime() + time.Second)
+		ok, absent, err := mutexes.Lock(ctx, "id")
+		if err != nil {
+			t.Fatalf("Lock: %v", err)
+		}
+		if !ok || absent {
+			t.Fatalf("Lock after expiry: got ok=%v absent=%v, want ok=true absent=false", ok, absent)
+		}
+		mutexes.UnlockAll(ctx, []any{"id"})
+	})
+}
+
+func mustNewAndLock(t *testing.T, mutexes arp.Mutexes, id any) {
+	t.Helper()
+	ok, err := mutexes.NewAndLock(context.Background(), id)
+	if err != nil || !ok {
+		t.Fatalf("NewAndLock %v: got ok=%v err=%v, want ok=true", id, ok, err)
+	}
+}
+
+type lockResult struct {
+	ok  bool
+	err error
+}
+
+func lockAsync(ctx context.Context, mutexes arp.Mutexes, id any) <-chan lockResult {
+	result := make(chan lockResult, 1)
+	go func() {
+		ok, _, err := mutexes.Lock(ctx, id)
+		result <- lockResult{ok, err}
+	}()
+	return result
+}
+
+//可以手动拨动的时钟
+type FakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+//MongodbMutexes的Factory，每个子测试使用一个新的锁集合，测试结束后删除
+func MongodbMutexesFactory(client *mongo.Client, database string) Factory {
+	return func(t *testing.T) arp.Mutexes {
+		collection := fmt.Sprintf("conformance_%d", time.Now().UnixNano())
+		mutexes := mongorepo.NewMongodbMutexes(client, database, collection)
+		t.Cleanup(func() {
+			client.Database(database).Collection("mutexes_" + collection).Drop(context.Background())
+		})
+		return mutexes
+	}
+}
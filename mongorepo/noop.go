@@ -0,0 +1,36 @@
+package mongorepo
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+//开启后SaveAll更新实体前会先读出库里的文档，和序列化后的实体逐字节比较，完全相同就不写，避免无意义的写入和oplog。
+//每次更新多一次读取，适合读便宜、写贵或者大部分保存都没有修改的场景。跳过的次数可以用SkippedUpdates查看。
+//比较时不算本次的操作者，只有操作者不同不会写入；GridFS大字段按内容摘要比较，没有修改时不会上传
+func (store *MongodbStore[T]) SetSkipUnchangedUpdates(skip bool) {
+	store.skipUnchanged = skip
+}
+
+//因为没有变化而跳过的更新次数
+func (store *MongodbStore[T]) SkippedUpdates() uint64 {
+	return atomic.LoadUint64(&store.skippedUpdates)
+}
+
+//stored为替换前读出的库里文档，doc为带上了原来审计字段、还没有写入操作者的文档
+func (store *MongodbStore[T]) unchanged(stored bson.Raw, doc any) (bool, error) {
+	if !store.skipUnchanged || stored == nil {
+		return false, nil
+	}
+	marshaled, err := bson.MarshalWithRegistry(store.registry, doc)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(stored, marshaled) {
+		return false, nil
+	}
+	atomic.AddUint64(&store.skippedUpdates, 1)
+	return true, nil
+}
@@ -0,0 +1,69 @@
+package mongorepo_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestSkipUnchangedUpdates(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	coll := client.Database(testDatabase).Collection(testCollection(t, client))
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	store.SetSkipUnchangedUpdates(true)
+	if err := store.Save(ctx, "a", &testOrder{"a", "new", 1}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if _, err := store.UpdateIfPresent(ctx, "a", &testOrder{"a", "new", 1}); err != nil {
+		t.Fatalf("UpdateIfPresent unchanged: %v", err)
+	}
+	if skipped := store.SkippedUpdates(); skipped != 1 {
+		t.Fatalf("SkippedUpdates = %d after an unchanged update, want 1", skipped)
+	}
+	if _, err := store.UpdateIfPresent(ctx, "a", &testOrder{"a", "paid", 1}); err != nil {
+		t.Fatalf("UpdateIfPresent changed: %v", err)
+	}
+	if skipped := store.SkippedUpdates(); skipped != 1 {
+		t.Fatalf("SkippedUpdates = %d after a changed update, want 1", skipped)
+	}
+	if order, _, _ := store.Load(ctx, "a"); order.Status != "paid" {
+		t.Fatalf("status = %q, want paid", order.Status)
+	}
+}
+
+func TestSkipUnchangedUpdatesWithAuditAndGridFS(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	collection := testCollection(t, client)
+	db := client.Database(testDatabase)
+	bucket, err := gridfs.NewBucket(db, options.GridFSBucket().SetName(collection))
+	if err != nil {
+		t.Fatalf("NewBucket: %v", err)
+	}
+	store := mongorepo.NewMongodbStoreWithGridFS(db.Collection(collection), func() *testDocument { return &testDocument{} }, bucket, "content")
+	store.SetAuditActorKey(actorKey{}, false)
+	store.SetSkipUnchangedUpdates(true)
+	if err = store.Save(context.WithValue(ctx, actorKey{}, "alice"), "d", &testDocument{"d", []byte("large content")}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	//内容没变，只是操作者不同
+	if _, err = store.UpdateIfPresent(context.WithValue(ctx, actorKey{}, "bob"), "d", &testDocument{"d", []byte("large content")}); err != nil {
+		t.Fatalf("UpdateIfPresent: %v", err)
+	}
+	if skipped := store.SkippedUpdates(); skipped != 1 {
+		t.Fatalf("SkippedUpdates = %d, want 1", skipped)
+	}
+	if count, _ := db.Collection(collection+".files").CountDocuments(ctx, bson.D{}); count != 1 {
+		t.Fatalf("files = %d, want 1", count)
+	}
+	_, raw, _, err := store.LoadRaw(ctx, "d")
+	if err != nil || raw[mongorepo.UpdatedByField] != "alice" {
+		t.Fatalf("updatedBy = %v err=%v, want alice", raw[mongorepo.UpdatedByField], err)
+	}
+}
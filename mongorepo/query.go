@@ -0,0 +1,415 @@
+package mongorepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//按字段查询，按sortField排序后取前n个
+func (repo *MongodbRepository[T]) QueryTopN(ctx context.Context, fieldName string, fieldValue any, sortField string, ascending bool, n int64) ([]T, error) {
+	if n <= 0 {
+		return nil, errors.New("QueryTopN: n must be greater than 0")
+	}
+	if repo.coll == nil {
+		return make([]T, 0), nil
+	}
+	order := -1
+	if ascending {
+		order = 1
+	}
+	opts := findOptions(ctx).SetSort(bson.D{{sortField, order}}).SetLimit(n)
+	cursor, err := repo.coll.Find(ctx, bson.D{{fieldName, fieldValue}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	return repo.decodeAll(ctx, cursor)
+}
+
+//按任意条件查询一个实体，可以通过opts指定排序等，例如取最新的一个
+func (repo *MongodbRepository[T]) FindOne(ctx context.Context, filter any, opts ...*options.FindOneOptions) (entity T, found bool, err error) {
+	if repo.coll == nil {
+		return entity, false, nil
+	}
+	if collation := collationFrom(ctx); collation != nil {
+		opts = append([]*options.FindOneOptions{options.FindOne().SetCollation(collation)}, opts...)
+	}
+	raw, err := repo.coll.FindOne(ctx, filter, opts...).DecodeBytes()
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return entity, false, nil
+		}
+		return entity, false, err
+	}
+	if entity, err = repo.decode(raw); err != nil {
+		return entity, false, err
+	}
+	return entity, true, nil
+}
+
+func (repo *MongodbRepository[T]) decode(raw bson.Raw) (entity T, err error) {
+	entity = repo.newZeroEntity()
+	if err = bson.Unmarshal(raw, entity); err != nil {
+		return entity, err
+	}
+	return entity, nil
+}
+
+func (repo *MongodbRepository[T]) decodeAll(ctx context.Context, cursor *mongo.Cursor) ([]T, error) {
+	defer cursor.Close(ctx)
+	entities := make([]T, 0)
+	for cursor.Next(ctx) {
+		if err := repo.checkResultSize(len(entities) + 1); err != nil {
+			return nil, err
+		}
+		entity, err := repo.decode(cursor.Current)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, entity)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return entities, nil
+}
+
+//按字段查询，并用$project附加计算字段（例如$dateToString），结果解码成调用者提供的类型R。
+//projection就是$project阶段的内容，例如：
+//bson.D{{"name", 1}, {"day", bson.D{{"$dateToString", bson.D{{"format", "%Y-%m-%d"}, {"date", "$createTime"}}}}}}
+func QueryAllByFieldProjected[R any, T any](ctx context.Context, repo *MongodbRepository[T], fieldName string, fieldValue any, projection bson.D) ([]R, error) {
+	if repo.coll == nil {
+		return make([]R, 0), nil
+	}
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.D{{fieldName, fieldValue}}}},
+		{{"$project", projection}},
+	}
+	aggOpts := options.Aggregate()
+	if collation := collationFrom(ctx); collation != nil {
+		aggOpts.SetCollation(collation)
+	}
+	cursor, err := repo.coll.Aggregate(ctx, pipeline, aggOpts)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]R, 0)
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+//用一次$in查询取出字段值在values中的实体，按字段值分组返回，分组的key是调用者传入的values中的值。
+//整数按数值比较，int、int32、int64传入都能对上库里的值。字段是数组（或路径经过数组）时，实体会出现在每个匹配到的元素的分组里
+func (repo *MongodbRepository[T]) QueryAllByFieldValuesGrouped(ctx context.Context, fieldName string, values []any) (map[any][]T, error) {
+	grouped := make(map[any][]T)
+	if repo.coll == nil || len(values) == 0 {
+		return grouped, nil
+	}
+	valuesByKey := make(map[string]any, len(values))
+	for _, value := range values {
+		t, data, err := bson.MarshalValue(value)
+		if err != nil {
+			return nil, err
+		}
+		rawValue := bson.RawValue{Type: t, Value: data}
+		if value != nil && !reflect.TypeOf(value).Comparable() {
+			value = rawIdValue(rawValue)
+		}
+		valuesByKey[groupKey(rawValue)] = value
+	}
+	filter := bson.D{{fieldName, bson.D{{"$in", values}}}}
+	cursor, err := repo.coll.Find(ctx, filter, repo.limitResult(findOptions(ctx)))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	path := strings.Split(fieldName, ".")
+	count := 0
+	for cursor.Next(ctx) {
+		count++
+		if err = repo.checkResultSize(count); err != nil {
+			return nil, err
+		}
+		entity, err := repo.decode(cursor.Current)
+		if err != nil {
+			return nil, err
+		}
+		matched := make(map[string]bool)
+		for _, fieldValue := range pathValues(bson.RawValue{Type: bson.TypeEmbeddedDocument, Value: cursor.Current}, path) {
+			key := groupKey(fieldValue)
+			value, ok := valuesByKey[key]
+			if !ok || matched[key] {
+				continue
+			}
+			matched[key] = true
+			grouped[value] = append(grouped[value], entity)
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+	return grouped, nil
+}
+
+//取出文档中path对应的所有值。路径经过数组时展开数组的每个元素，最终的值是数组时，数组本身和它的每个元素都算在内，和$in的匹配规则一致
+func pathValues(value bson.RawValue, path []string) []bson.RawValue {
+	if len(path) == 0 {
+		values := []bson.RawValue{value}
+		if value.Type == bson.TypeArray {
+			elems, _ := value.Array().Values()
+			values = append(values, elems...)
+		}
+		return values
+	}
+	switch value.Type {
+	case bson.TypeEmbeddedDocument:
+		next, err := value.Document().LookupErr(path[0])
+		if err != nil {
+			return nil
+		}
+		return pathValues(next, path[1:])
+	case bson.TypeArray:
+		elems, _ := value.Array().Values()
+		values := make([]bson.RawValue, 0)
+		for _, elem := range elems {
+			values = append(values, pathValues(elem, path)...)
+		}
+		return values
+	}
+	return nil
+}
+
+//和idKey一样按bson类型和内容生成key，但int32统一成int64，使不同宽度的整数能对上
+func groupKey(value bson.RawValue) string {
+	if i32, ok := value.Int32OK(); ok {
+		t, data, _ := bson.MarshalValue(int64(i32))
+		return rawIdKey(bson.RawValue{Type: t, Value: data})
+	}
+	return rawIdKey(value)
+}
+
+//按正则表达式查询字符串字段，caseInsensitive为true时忽略大小写。
+//只有以^开头、区分大小写的前缀匹配（例如"^abc"）能有效利用索引，子串匹配和忽略大小写的匹配都要扫描整个索引或集合，大集合上慎用
+func (repo *MongodbRepository[T]) QueryAllByRegex(ctx context.Context, fieldName string, pattern string, caseInsensitive bool) ([]T, error) {
+	if repo.coll == nil {
+		return make([]T, 0), nil
+	}
+	regex := primitive.Regex{Pattern: pattern}
+	if caseInsensitive {
+		regex.Options = "i"
+	}
+	cursor, err := repo.coll.Find(ctx, bson.D{{fieldName, regex}}, repo.limitResult(findOptions(ctx)))
+	if err != nil {
+		return nil, err
+	}
+	return repo.decodeAll(ctx, cursor)
+}
+
+//在maxWait内尝试精确计数，超时则返回估算值，exact为false
+func (repo *MongodbRepository[T]) CountExactOrEstimate(ctx context.Context, maxWait time.Duration) (count uint64, exact bool, err error) {
+	if repo.coll == nil {
+		return 0, true, nil
+	}
+	countCtx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
+	exactCount, err := repo.coll.CountDocuments(countCtx, bson.D{}, options.Count().SetMaxTime(maxWait))
+	if err == nil {
+		return uint64(exactCount), true, nil
+	}
+	if ctx.Err() != nil || (countCtx.Err() == nil && !mongo.IsTimeout(err)) {
+		return 0, false, err
+	}
+	estimated, err := repo.coll.EstimatedDocumentCount(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	return uint64(estimated), false, nil
+}
+
+//按sortField升序做游标分页，返回afterValue之后的最多limit个实体，以及下一页的游标（本页最后一个实体的sortField值）。
+//afterValue为nil时从头开始；没有下一页时返回的游标为nil。sortField的值需要唯一，否则相同值的实体可能被跳过
+func (repo *MongodbRepository[T]) QueryAfter(ctx context.Context, sortField string, afterValue any, limit int64) ([]T, any, error) {
+	if limit <= 0 {
+		return nil, nil, errors.New("QueryAfter: limit must be greater than 0")
+	}
+	if repo.coll == nil {
+		return make([]T, 0), nil, nil
+	}
+	filter := bson.D{}
+	if afterValue != nil {
+		filter = bson.D{{sortField, bson.D{{"$gt", afterValue}}}}
+	}
+	opts := findOptions(ctx).SetSort(bson.D{{sortField, 1}}).SetLimit(limit)
+	cursor, err := repo.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cursor.Close(ctx)
+	entities := make([]T, 0)
+	var last bson.RawValue
+	for cursor.Next(ctx) {
+		entity, err := repo.decode(cursor.Current)
+		if err != nil {
+			return nil, nil, err
+		}
+		entities = append(entities, entity)
+		last = cursor.Current.Lookup(strings.Split(sortField, ".")...)
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, nil, err
+	}
+	if int64(len(entities)) < limit {
+		return entities, nil, nil
+	}
+	return entities, last, nil
+}
+
+//返回按字段查询的执行计划，用于排查缺少索引导致的全表扫描（COLLSCAN）
+func (repo *MongodbRepository[T]) ExplainQueryByField(ctx context.Context, fieldName string, fieldValue any) (bson.M, error) {
+	if repo.coll == nil {
+		return nil, nil
+	}
+	find := bson.D{{"find", repo.coll.Name()}, {"filter", bson.D{{fieldName, fieldValue}}}}
+	if collation := collationFrom(ctx); collation != nil {
+		find = append(find, bson.E{"collation", collation})
+	}
+	cmd := bson.D{{"explain", find}, {"verbosity", "queryPlanner"}}
+	var plan bson.M
+	if err := repo.coll.Database().RunCommand(ctx, cmd).Decode(&plan); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+//按id范围查询，结果按id升序。inclusive为true时包含minId和maxId，minId或maxId为nil表示该端不限
+func (repo *MongodbRepository[T]) QueryByIdRange(ctx context.Context, minId, maxId any, inclusive bool) ([]T, error) {
+	if repo.coll == nil {
+		return make([]T, 0), nil
+	}
+	gt, lt := "$gt", "$lt"
+	if inclusive {
+		gt, lt = "$gte", "$lte"
+	}
+	idRange := bson.D{}
+	if minId != nil {
+		mid, err := repo.store.marshalId(minId)
+		if err != nil {
+			return nil, err
+		}
+		idRange = append(idRange, bson.E{gt, mid})
+	}
+	if maxId != nil {
+		mid, err := repo.store.marshalId(maxId)
+		if err != nil {
+			return nil, err
+		}
+		idRange = append(idRange, bson.E{lt, mid})
+	}
+	filter := bson.D{}
+	if len(idRange) > 0 {
+		filter = bson.D{{repo.store.idField, idRange}}
+	}
+	opts := repo.limitResult(findOptions(ctx).SetSort(bson.D{{repo.store.idField, 1}}))
+	cursor, err := repo.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	return repo.decodeAll(ctx, cursor)
+}
+
+//流式读取聚合结果，不把所有结果一次读进内存。返回的next每次返回一个文档，读完（ok为false）、出错或者ctx被取消时游标会被关闭。
+//中途不再读取时，取消ctx即可释放游标
+func (repo *MongodbRepository[T]) AggregateStream(ctx context.Context, pipeline mongo.Pipeline) (next func() (doc bson.M, ok bool, err error), err error) {
+	if repo.coll == nil {
+		return func() (bson.M, bool, error) { return nil, false, nil }, nil
+	}
+	aggOpts := options.Aggregate()
+	if collation := collationFrom(ctx); collation != nil {
+		aggOpts.SetCollation(collation)
+	}
+	cursor, err := repo.coll.Aggregate(ctx, pipeline, aggOpts)
+	if err != nil {
+		return nil, err
+	}
+	//mutex保证关闭游标和读取游标不会同时进行
+	var (
+		mutex  sync.Mutex
+		closed bool
+		done   = make(chan struct{})
+	)
+	closeLocked := func() {
+		if !closed {
+			closed = true
+			close(done)
+			cursor.Close(context.Background())
+		}
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			mutex.Lock()
+			closeLocked()
+			mutex.Unlock()
+		case <-done:
+		}
+	}()
+	next = func() (bson.M, bool, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if closed {
+			return nil, false, ctx.Err()
+		}
+		if !cursor.Next(ctx) {
+			err := cursor.Err()
+			closeLocked()
+			return nil, false, err
+		}
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			closeLocked()
+			return nil, false, err
+		}
+		return doc, true, nil
+	}
+	return next, nil
+}
+
+//查询结果超过了设置的上限
+type ErrResultTooLarge struct {
+	Limit int64
+}
+
+func (e *ErrResultTooLarge) Error() string {
+	return fmt.Sprintf("query result exceeds limit of %d documents", e.Limit)
+}
+
+//设置QueryAllByField等查询最多加载的文档数，超过时返回*ErrResultTooLarge，防止意外加载过多数据耗尽内存。默认为0，不限制
+func (repo *MongodbRepository[T]) SetMaxResultSize(maxResultSize int64) {
+	repo.maxResultSize = maxResultSize
+}
+
+//多取一个文档，用来判断是否超过上限
+func (repo *MongodbRepository[T]) limitResult(opts *options.FindOptions) *options.FindOptions {
+	if repo.maxResultSize > 0 && (opts.Limit == nil || *opts.Limit > repo.maxResultSize+1) {
+		opts.SetLimit(repo.maxResultSize + 1)
+	}
+	return opts
+}
+
+func (repo *MongodbRepository[T]) checkResultSize(count int) error {
+	if repo.maxResultSize > 0 && int64(count) > repo.maxResultSize {
+		return &ErrResultTooLarge{repo.maxResultSize}
+	}
+	return nil
+}
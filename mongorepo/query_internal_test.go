@@ -0,0 +1,45 @@
+package mongorepo
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPathValuesExpandsArrays(t *testing.T) {
+	doc, err := bson.Marshal(bson.D{
+		{"tags", bson.A{"a", "b"}},
+		{"items", bson.A{bson.D{{"sku", "x"}}, bson.D{{"sku", "y"}}, bson.D{{"qty", 1}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := bson.RawValue{Type: bson.TypeEmbeddedDocument, Value: doc}
+	//数组本身加上两个元素
+	if values := pathValues(root, []string{"tags"}); len(values) != 3 {
+		t.Fatalf("tags values = %v, want the array and its 2 elements", values)
+	}
+	values := pathValues(root, []string{"items", "sku"})
+	if len(values) != 2 || values[0].StringValue() != "x" || values[1].StringValue() != "y" {
+		t.Fatalf("items.sku values = %v, want x and y", values)
+	}
+	if values = pathValues(root, []string{"missing"}); len(values) != 0 {
+		t.Fatalf("missing values = %v, want none", values)
+	}
+}
+
+func TestGroupKeyMatchesIntegersOfDifferentWidths(t *testing.T) {
+	key := func(value any) string {
+		bsonType, data, err := bson.MarshalValue(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return groupKey(bson.RawValue{Type: bsonType, Value: data})
+	}
+	if key(int32(7)) != key(int64(7)) || key(7) != key(int64(7)) {
+		t.Fatalf("integers of different widths should share a group key")
+	}
+	if key(int64(7)) == key("7") {
+		t.Fatalf("different types should not share a group key")
+	}
+}
@@ -0,0 +1,446 @@
+package mongorepo_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type testTicket struct {
+	Id       string   `bson:"_id"`
+	Priority int      `bson:"priority"`
+	Tags     []string `bson:"tags"`
+}
+
+func TestQueryAllByFieldValuesGrouped(t *testing.T) {
+	ctx := context.Background()
+	var mutex sync.Mutex
+	finds := 0
+	monitor := &event.CommandMonitor{Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+		if e.CommandName == "find" {
+			mutex.Lock()
+			finds++
+			mutex.Unlock()
+		}
+	}}
+	client := testClient(t, options.Client().SetMonitor(monitor))
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, testCollection(t, client), func() *testTicket { return &testTicket{} })
+	for _, ticket := range []*testTicket{
+		{"t1", 1, []string{"db", "ui"}},
+		{"t2", 2, []string{"ui"}},
+		{"t3", 1, nil},
+	} {
+		if _, err := repo.InsertIfAbsent(ctx, ticket.Id, ticket); err != nil {
+			t.Fatalf("InsertIfAbsent: %v", err)
+		}
+	}
+
+	finds = 0
+	//库里存的是int32，按调用者传入的int64分组
+	byPriority, err := repo.QueryAllByFieldValuesGrouped(ctx, "priority", []any{int64(1), int64(2), int64(3)})
+	if err != nil {
+		t.Fatalf("group by priority: %v", err)
+	}
+	if finds != 1 {
+		t.Fatalf("find round-trips = %d, want 1", finds)
+	}
+	if len(byPriority) != 2 || len(byPriority[int64(1)]) != 2 || len(byPriority[int64(2)]) != 1 {
+		t.Fatalf("byPriority = %v", byPriority)
+	}
+
+	byTag, err := repo.QueryAllByFieldValuesGrouped(ctx, "tags", []any{"db", "ui", "api"})
+	if err != nil {
+		t.Fatalf("group by tags: %v", err)
+	}
+	if len(byTag) != 2 || len(byTag["db"]) != 1 || len(byTag["ui"]) != 2 {
+		t.Fatalf("byTag = %v", byTag)
+	}
+}
+
+type testEvent struct {
+	Id         string    `bson:"_id"`
+	Kind       string    `bson:"kind"`
+	CreateTime time.Time `bson:"createTime"`
+}
+
+type eventDay struct {
+	Id  string `bson:"_id"`
+	Day string `bson:"day"`
+}
+
+func TestQueryAllByFieldProjected(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, testCollection(t, client), func() *testEvent { return &testEvent{} })
+	createTime := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	repo.InsertIfAbsent(ctx, "e1", &testEvent{"e1", "login", createTime})
+	repo.InsertIfAbsent(ctx, "e2", &testEvent{"e2", "logout", createTime})
+	projection := bson.D{{"day", bson.D{{"$dateToString", bson.D{{"format", "%Y-%m-%d"}, {"date", "$createTime"}}}}}}
+	days, err := mongorepo.QueryAllByFieldProjected[eventDay](ctx, repo, "kind", "login", projection)
+	if err != nil {
+		t.Fatalf("QueryAllByFieldProjected: %v", err)
+	}
+	if len(days) != 1 || days[0] != (eventDay{"e1", "2024-03-05"}) {
+		t.Fatalf("days = %+v, want e1 on 2024-03-05", days)
+	}
+}
+
+func TestQueryAllByFieldProjectedWithoutClient(t *testing.T) {
+	repo := mongorepo.NewMongodbRepository(nil, testDatabase, "events", func() *testEvent { return &testEvent{} })
+	days, err := mongorepo.QueryAllByFieldProjected[eventDay](context.Background(), repo, "kind", "login", bson.D{})
+	if err != nil || days == nil || len(days) != 0 {
+		t.Fatalf("QueryAllByFieldProjected = %v err=%v, want an empty non-nil slice", days, err)
+	}
+}
+
+func TestQueryTopN(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, testCollection(t, client), newTestOrder)
+	for i, qty := range []int{5, 9, 1, 7, 3, 8} {
+		id := fmt.Sprintf("o%d", i)
+		repo.InsertIfAbsent(ctx, id, &testOrder{id, "new", qty})
+	}
+	repo.InsertIfAbsent(ctx, "other", &testOrder{"other", "paid", 100})
+	top, err := repo.QueryTopN(ctx, "status", "new", "qty", false, 3)
+	if err != nil {
+		t.Fatalf("QueryTopN: %v", err)
+	}
+	qtys := make([]int, 0, len(top))
+	for _, order := range top {
+		qtys = append(qtys, order.Qty)
+	}
+	if !reflect.DeepEqual(qtys, []int{9, 8, 7}) {
+		t.Fatalf("top 3 descending = %v, want [9 8 7]", qtys)
+	}
+	bottom, err := repo.QueryTopN(ctx, "status", "new", "qty", true, 2)
+	if err != nil || len(bottom) != 2 || bottom[0].Qty != 1 || bottom[1].Qty != 3 {
+		t.Fatalf("bottom 2 ascending = %v err=%v, want qty 1 and 3", bottom, err)
+	}
+	if _, err = repo.QueryTopN(ctx, "status", "new", "qty", true, 0); err == nil {
+		t.Fatalf("QueryTopN with n=0 should fail")
+	}
+}
+
+func TestQueryTopNWithoutClient(t *testing.T) {
+	repo := mongorepo.NewMongodbRepository(nil, testDatabase, "orders", newTestOrder)
+	top, err := repo.QueryTopN(context.Background(), "status", "new", "qty", false, 3)
+	if err != nil || top == nil || len(top) != 0 {
+		t.Fatalf("QueryTopN = %v err=%v, want an empty non-nil slice", top, err)
+	}
+}
+
+func TestFindOneWithSortFetchesLatest(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, testCollection(t, client), func() *testEvent { return &testEvent{} })
+	base := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	for i, offset := range []int{2, 5, 1} {
+		id := fmt.Sprintf("e%d", i)
+		repo.InsertIfAbsent(ctx, id, &testEvent{id, "login", base.Add(time.Duration(offset) * time.Hour)})
+	}
+	repo.InsertIfAbsent(ctx, "later", &testEvent{"later", "logout", base.Add(10 * time.Hour)})
+	latest, found, err := repo.FindOne(ctx, bson.D{{"kind", "login"}}, options.FindOne().SetSort(bson.D{{"createTime", -1}}))
+	if err != nil || !found || latest.Id != "e1" {
+		t.Fatalf("FindOne latest = %+v found=%v err=%v, want e1", latest, found, err)
+	}
+	if _, found, err = repo.FindOne(ctx, bson.D{{"kind", "absent"}}); err != nil || found {
+		t.Fatalf("FindOne absent: found=%v err=%v", found, err)
+	}
+}
+
+func TestCountExactOrEstimate(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, testCollection(t, client), newTestOrder)
+	for _, id := range []string{"a", "b", "c"} {
+		repo.InsertIfAbsent(ctx, id, &testOrder{id, "new", 1})
+	}
+	count, exact, err := repo.CountExactOrEstimate(ctx, 10*time.Second)
+	if err != nil || !exact || count != 3 {
+		t.Fatalf("fast count = %d exact=%v err=%v, want exact 3", count, exact, err)
+	}
+	//精确计数来不及完成，退回估算
+	count, exact, err = repo.CountExactOrEstimate(ctx, time.Nanosecond)
+	if err != nil || exact || count != 3 {
+		t.Fatalf("slow count = %d exact=%v err=%v, want estimated 3", count, exact, err)
+	}
+}
+
+func TestQueryAfterPagesThroughEverything(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, testCollection(t, client), newTestOrder)
+	want := make([]string, 0, 25)
+	for i := 0; i < 25; i++ {
+		id := fmt.Sprintf("o%02d", i)
+		want = append(want, id)
+		repo.InsertIfAbsent(ctx, id, &testOrder{id, "new", i})
+	}
+	got := make([]string, 0, len(want))
+	var cursor any
+	for pages := 0; ; pages++ {
+		if pages > len(want) {
+			t.Fatalf("paging did not terminate, got %v", got)
+		}
+		page, next, err := repo.QueryAfter(ctx, "_id", cursor, 7)
+		if err != nil {
+			t.Fatalf("QueryAfter: %v", err)
+		}
+		for _, order := range page {
+			got = append(got, order.Id)
+		}
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("paged ids = %v, want %v without gaps or duplicates", got, want)
+	}
+	//limit只是上限，很大的值不会预先分配
+	all, next, err := repo.QueryAfter(ctx, "_id", nil, math.MaxInt64)
+	if err != nil || len(all) != len(want) || next != nil {
+		t.Fatalf("QueryAfter with a huge limit = %d entities next=%v err=%v", len(all), next, err)
+	}
+}
+
+//收集执行计划中所有的stage，兼容经典引擎的inputStage和SBE引擎嵌套的queryPlan
+func planStages(plan any) []string {
+	var stages []string
+	switch value := plan.(type) {
+	case bson.M:
+		if stage, ok := value["stage"].(string); ok {
+			stages = append(stages, stage)
+		}
+		for _, child := range value {
+			stages = append(stages, planStages(child)...)
+		}
+	case bson.A:
+		for _, child := range value {
+			stages = append(stages, planStages(child)...)
+		}
+	}
+	return stages
+}
+
+func TestExplainQueryByField(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, testCollection(t, client), newTestOrder)
+	repo.InsertIfAbsent(ctx, "o1", &testOrder{"o1", "new", 1})
+	hasStage := func(want string) bool {
+		plan, err := repo.ExplainQueryByField(ctx, "status", "new")
+		if err != nil {
+			t.Fatalf("ExplainQueryByField: %v", err)
+		}
+		queryPlanner, _ := plan["queryPlanner"].(bson.M)
+		for _, stage := range planStages(queryPlanner["winningPlan"]) {
+			if stage == want {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasStage("COLLSCAN") {
+		t.Fatalf("plan without an index has no COLLSCAN stage")
+	}
+	if err := repo.EnsureFieldIndex(ctx, "status", false); err != nil {
+		t.Fatalf("EnsureFieldIndex: %v", err)
+	}
+	if !hasStage("IXSCAN") {
+		t.Fatalf("plan with an index has no IXSCAN stage")
+	}
+}
+
+func TestQueryByIdRange(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, testCollection(t, client), newTestOrder)
+	for _, id := range []string{"e", "a", "c", "b", "d"} {
+		repo.InsertIfAbsent(ctx, id, &testOrder{id, "new", 1})
+	}
+	cases := []struct {
+		minId, maxId any
+		inclusive    bool
+		want         []string
+	}{
+		{"b", "d", true, []string{"b", "c", "d"}},
+		{"b", "d", false, []string{"c"}},
+		{nil, "b", true, []string{"a", "b"}},
+		{"d", nil, false, []string{"e"}},
+		{nil, nil, false, []string{"a", "b", "c", "d", "e"}},
+	}
+	for _, c := range cases {
+		orders, err := repo.QueryByIdRange(ctx, c.minId, c.maxId, c.inclusive)
+		if err != nil {
+			t.Fatalf("QueryByIdRange(%v, %v, %v): %v", c.minId, c.maxId, c.inclusive, err)
+		}
+		ids := make([]string, 0, len(orders))
+		for _, order := range orders {
+			ids = append(ids, order.Id)
+		}
+		if !reflect.DeepEqual(ids, c.want) {
+			t.Fatalf("QueryByIdRange(%v, %v, %v) = %v, want %v", c.minId, c.maxId, c.inclusive, ids, c.want)
+		}
+	}
+}
+
+//统计发给某个集合的getMore和killCursors命令
+type cursorRecorder struct {
+	collection  string
+	getMores    int32
+	killCursors int32
+}
+
+func (r *cursorRecorder) monitor() *event.CommandMonitor {
+	return &event.CommandMonitor{Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+		switch e.CommandName {
+		case "getMore":
+			if e.Command.Lookup("collection").StringValue() == r.collection {
+				atomic.AddInt32(&r.getMores, 1)
+			}
+		case "killCursors":
+			if e.Command.Lookup("killCursors").StringValue() == r.collection {
+				atomic.AddInt32(&r.killCursors, 1)
+			}
+		}
+	}}
+}
+
+func TestAggregateStream(t *testing.T) {
+	ctx := context.Background()
+	recorder := &cursorRecorder{}
+	client := testClient(t, options.Client().SetMonitor(recorder.monitor()))
+	recorder.collection = testCollection(t, client)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, recorder.collection, newTestOrder)
+	const count = 500
+	docs := make([]any, 0, count)
+	for i := 0; i < count; i++ {
+		docs = append(docs, &testOrder{fmt.Sprintf("o%03d", i), "new", i})
+	}
+	if _, err := client.Database(testDatabase).Collection(recorder.collection).InsertMany(ctx, docs); err != nil {
+		t.Fatalf("InsertMany: %v", err)
+	}
+	pipeline := mongo.Pipeline{{{"$sort", bson.D{{"_id", 1}}}}}
+
+	next, err := repo.AggregateStream(ctx, pipeline)
+	if err != nil {
+		t.Fatalf("AggregateStream: %v", err)
+	}
+	read := 0
+	for {
+		doc, ok, err := next()
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		if !ok {
+			break
+		}
+		if doc["qty"] != int32(read) {
+			t.Fatalf("document %d has qty %v", read, doc["qty"])
+		}
+		read++
+	}
+	//结果分多批从游标取回，而不是一次读完
+	if read != count || atomic.LoadInt32(&recorder.getMores) == 0 {
+		t.Fatalf("read %d documents with %d getMore, want %d streamed in batches", read, recorder.getMores, count)
+	}
+
+	//中途取消ctx，游标在服务器上被关闭
+	streamCtx, cancel := context.WithCancel(ctx)
+	next, err = repo.AggregateStream(streamCtx, pipeline)
+	if err != nil {
+		t.Fatalf("AggregateStream: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok, err := next(); !ok || err != nil {
+			t.Fatalf("next %d: ok=%v err=%v", i, ok, err)
+		}
+	}
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&recorder.killCursors) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("cursor not killed after cancel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok, err := next(); ok || err != context.Canceled {
+		t.Fatalf("next after cancel: ok=%v err=%v, want context.Canceled", ok, err)
+	}
+}
+
+func TestSetMaxResultSize(t *testing.T) {
+	ctx := context.Background()
+	var collection string
+	var returned int32
+	//记录服务器返回的文档数，确认超过上限时没有把所有匹配的文档都取回来
+	monitor := &event.CommandMonitor{Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+		if e.CommandName != "find" {
+			return
+		}
+		if ns, ok := e.Reply.Lookup("cursor", "ns").StringValueOK(); ok && ns == testDatabase+"."+collection {
+			batch, _ := e.Reply.Lookup("cursor", "firstBatch").Array().Values()
+			atomic.AddInt32(&returned, int32(len(batch)))
+		}
+	}}
+	client := testClient(t, options.Client().SetMonitor(monitor))
+	collection = testCollection(t, client)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, collection, newTestOrder)
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("o%02d", i)
+		repo.InsertIfAbsent(ctx, id, &testOrder{id, "new", i})
+	}
+	repo.SetMaxResultSize(10)
+	orders, err := repo.QueryAllByField(ctx, "status", "new")
+	var tooLarge *mongorepo.ErrResultTooLarge
+	if !errors.As(err, &tooLarge) || tooLarge.Limit != 10 || orders != nil {
+		t.Fatalf("QueryAllByField = %d orders err=%v, want *ErrResultTooLarge with limit 10", len(orders), err)
+	}
+	if n := atomic.LoadInt32(&returned); n != 11 {
+		t.Fatalf("server returned %d documents, want 11", n)
+	}
+	repo.SetMaxResultSize(20)
+	if orders, err = repo.QueryAllByField(ctx, "status", "new"); err != nil || len(orders) != 20 {
+		t.Fatalf("QueryAllByField = %d orders err=%v, want all 20 within the limit", len(orders), err)
+	}
+}
+
+func TestQueryAllByRegex(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, testCollection(t, client), newTestOrder)
+	for _, order := range []*testOrder{{"1", "Pending", 1}, {"2", "paid", 1}, {"3", "prepaid", 1}} {
+		repo.InsertIfAbsent(ctx, order.Id, order)
+	}
+	cases := []struct {
+		pattern         string
+		caseInsensitive bool
+		want            int
+	}{
+		{"^pa", false, 1},
+		{"paid", false, 2},
+		{"^pen", false, 0},
+		{"^pen", true, 1},
+	}
+	for _, c := range cases {
+		orders, err := repo.QueryAllByRegex(ctx, "status", c.pattern, c.caseInsensitive)
+		if err != nil || len(orders) != c.want {
+			t.Fatalf("QueryAllByRegex(%q, %v) = %d orders err=%v, want %d", c.pattern, c.caseInsensitive, len(orders), err, c.want)
+		}
+	}
+}
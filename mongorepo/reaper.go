@@ -0,0 +1,69 @@
+package mongorepo
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+//观察后台清理锁记录的错误。设置给MongodbMutexes的observer如果同时实现了这个接口，StartReaper中每次清理失败都会被调用
+type ReapObserver interface {
+	ReapFailed(err error)
+}
+
+//删除最后一次上锁时间早于olderThan之前的锁记录，返回删除的数量。
+//只删除已释放的锁和超过最长上锁时间的锁，仍然有效的锁即使早于olderThan也不会删除。
+//被删除的锁在下次Take时会重新补锁
+func (mutexes *MongodbMutexes) ReapExpired(ctx context.Context, olderThan time.Duration) (reaped int64, err error) {
+	now := mutexes.nowMillis()
+	expireTime := now - uint64(olderThan.Milliseconds())
+	unlockTime := now - mutexes.maxLockTime
+	filter := bson.D{
+		{"time", bson.D{{"$lt", expireTime}}},
+		{"$or", bson.A{
+			bson.D{{"state", 0}},
+			bson.D{{"time", bson.D{{"$lt", unlockTime}}}},
+		}},
+	}
+	dr, err := mutexes.coll.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return dr.DeletedCount, nil
+}
+
+const defaultReapInterval = time.Minute
+
+//在后台按interval周期性执行ReapExpired，直到调用返回的stop或者ctx被取消。stop可以重复调用。
+//interval不大于0时使用默认的1分钟。清理失败会报告给实现了ReapObserver的observer
+func (mutexes *MongodbMutexes) StartReaper(ctx context.Context, interval time.Duration, olderThan time.Duration) (stop func()) {
+	if interval <= 0 {
+		interval = defaultReapInterval
+	}
+	done := make(chan struct{})
+	var once sync.Once
+	stop = func() {
+		once.Do(func() { close(done) })
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := mutexes.ReapExpired(ctx, olderThan); err != nil {
+					if reapObserver, ok := mutexes.observer.(ReapObserver); ok {
+						reapObserver.ReapFailed(err)
+					}
+				}
+			}
+		}
+	}()
+	return stop
+}
@@ -0,0 +1,66 @@
+package mongorepo_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+)
+
+func TestReapExpiredKeepsHeldLocks(t *testing.T) {
+	ctx := context.Background()
+	mutexes, clock := testMutexes(t, testClient(t))
+	mutexes.NewAndLock(ctx, "held")
+	mutexes.NewAndLock(ctx, "free")
+	mutexes.UnlockAll(ctx, []any{"free"})
+	clock.Advance(10 * time.Second)
+
+	reaped, err := mutexes.ReapExpired(ctx, time.Second)
+	if err != nil || reaped != 1 {
+		t.Fatalf("ReapExpired = %d err=%v, want only the released lock", reaped, err)
+	}
+	if _, _, held, _, err := mutexes.LockInfo(ctx, "held"); err != nil || !held {
+		t.Fatalf("held lock: held=%v err=%v", held, err)
+	}
+	clock.Advance(mutexes.MaxLockTime())
+	if reaped, err = mutexes.ReapExpired(ctx, time.Second); err != nil || reaped != 1 {
+		t.Fatalf("ReapExpired after MaxLockTime = %d err=%v, want 1", reaped, err)
+	}
+}
+
+func TestStartReaperReapsStaleLocksWithinTicks(t *testing.T) {
+	ctx := context.Background()
+	mutexes, clock := testMutexes(t, testClient(t))
+	mutexes.NewAndLock(ctx, "held")
+	mutexes.NewAndLock(ctx, "free")
+	mutexes.UnlockAll(ctx, []any{"free"})
+	clock.Advance(10 * time.Second)
+
+	const interval = 100 * time.Millisecond
+	stop := mutexes.StartReaper(ctx, interval, time.Second)
+	defer stop()
+	deadline := time.Now().Add(3 * interval)
+	for {
+		_, _, _, _, err := mutexes.LockInfo(ctx, "free")
+		if errors.Is(err, mongorepo.ErrMutexNotFound) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stale lock not reaped within a couple of ticks: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, _, held, _, err := mutexes.LockInfo(ctx, "held"); err != nil || !held {
+		t.Fatalf("held lock: held=%v err=%v", held, err)
+	}
+}
+
+func TestStartReaperStopIsIdempotent(t *testing.T) {
+	//间隔不大于0时使用默认间隔，不会立即访问数据库
+	mutexes := mongorepo.NewMongodbMutexes(offlineClient(t), testDatabase, "orders")
+	stop := mutexes.StartReaper(context.Background(), 0, time.Minute)
+	stop()
+	stop()
+}
@@ -0,0 +1,47 @@
+package mongorepo
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//给当前实例持有的多把锁续期（把上锁时间更新为现在），用于持有多把锁的长事务定期心跳，避免锁过期被抢。
+//只有仍处于上锁状态且持有者是当前实例的锁会被续期，返回被续期的id
+func (mutexes *MongodbMutexes) RefreshAll(ctx context.Context, ids []any) (refreshed []any, err error) {
+	refreshed = make([]any, 0, len(ids))
+	if len(ids) == 0 {
+		return refreshed, nil
+	}
+	currTime := mutexes.nowMillis()
+	filter := bson.D{
+		{"_id", bson.D{{"$in", ids}}},
+		{"state", 1},
+		{"owner", mutexes.instanceId},
+	}
+	update := bson.D{{"$set", bson.D{{"time", currTime}}}}
+	if _, err = mutexes.coll.UpdateMany(ctx, filter, update); err != nil {
+		return nil, err
+	}
+	//UpdateMany不返回更新了哪些文档，再查一次续期成功的
+	filter = append(filter, bson.E{"time", currTime})
+	cursor, err := mutexes.coll.Find(ctx, filter, options.Find().SetProjection(bson.D{{"_id", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	refreshedKeys := make(map[string]bool, len(ids))
+	for cursor.Next(ctx) {
+		refreshedKeys[rawIdKey(cursor.Current.Lookup("_id"))] = true
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if key, err := idKey(id); err == nil && refreshedKeys[key] {
+			refreshed = append(refreshed, id)
+		}
+	}
+	return refreshed, nil
+}
@@ -0,0 +1,53 @@
+package mongorepo_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo/mutexestest"
+)
+
+func TestRefreshAllKeepsLocksPastTheOriginalTTL(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	collection := testCollection(t, client)
+	clock := mutexestest.NewFakeClock(time.UnixMilli(time.Now().UnixMilli()))
+	holder := mongorepo.NewMongodbMutexes(client, testDatabase, collection)
+	holder.SetClock(clock)
+	holder.SetInstanceId("holder")
+	other := mongorepo.NewMongodbMutexes(client, testDatabase, collection)
+	other.SetClock(clock)
+	other.SetInstanceId("other")
+	ids := []any{"a", "b", "c"}
+	for _, id := range ids {
+		if ok, err := holder.NewAndLock(ctx, id); err != nil || !ok {
+			t.Fatalf("NewAndLock %v: ok=%v err=%v", id, ok, err)
+		}
+	}
+	//别人持有的锁和不存在的锁不会被续期
+	if ok, err := other.NewAndLock(ctx, "d"); err != nil || !ok {
+		t.Fatalf("NewAndLock d: ok=%v err=%v", ok, err)
+	}
+	step := holder.MaxLockTime() * 3 / 4
+	for i := 0; i < 2; i++ {
+		clock.Advance(step)
+		refreshed, err := holder.RefreshAll(ctx, []any{"a", "b", "c", "d", "absent"})
+		if err != nil || !reflect.DeepEqual(refreshed, ids) {
+			t.Fatalf("RefreshAll = %v err=%v, want %v", refreshed, err, ids)
+		}
+	}
+	//已经超过最初的最长上锁时间，但续期过的锁不能被抢
+	clock.Advance(step)
+	for _, id := range ids {
+		if ok, _, err := other.Lock(ctx, id); err != nil || ok {
+			t.Fatalf("Lock %v from another instance: ok=%v err=%v, want refused", id, ok, err)
+		}
+	}
+	//没有续期的d已经过期
+	if ok, _, err := holder.Lock(ctx, "d"); err != nil || !ok {
+		t.Fatalf("Lock expired d: ok=%v err=%v", ok, err)
+	}
+}
@@ -0,0 +1,32 @@
+package mongorepo
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//开启一个因果一致性会话，并把会话绑定到返回的ctx上。
+//之后使用这个ctx的读写都在同一个会话中，即便是从secondary读，也能读到之前在这个ctx中完成的写。
+//用完之后需要调用返回的end来结束会话
+func StartCausalSession(ctx context.Context, client *mongo.Client) (sessCtx context.Context, end func(), err error) {
+	if client == nil {
+		return ctx, func() {}, nil
+	}
+	sess, err := client.StartSession(options.Session().SetCausalConsistency(true))
+	if err != nil {
+		return ctx, func() {}, err
+	}
+	return mongo.NewSessionContext(ctx, sess), func() { sess.EndSession(context.Background()) }, nil
+}
+
+//在因果一致性会话中执行f
+func WithCausalSession(ctx context.Context, client *mongo.Client, f func(ctx context.Context) error) error {
+	sessCtx, end, err := StartCausalSession(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer end()
+	return f(sessCtx)
+}
@@ -0,0 +1,57 @@
+package mongorepo_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+//不是副本集时跳过测试
+func requireReplicaSet(t testing.TB, client *mongo.Client) {
+	t.Helper()
+	var hello struct {
+		SetName string `bson:"setName"`
+	}
+	if err := client.Database("admin").RunCommand(context.Background(), bson.D{{"hello", 1}}).Decode(&hello); err != nil || hello.SetName == "" {
+		t.Skip("MongoDB is not a replica set")
+	}
+}
+
+func TestCausalSessionReadsOwnWritesFromSecondary(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t, options.Client().
+		SetReadPreference(readpref.SecondaryPreferred()).
+		SetReadConcern(readconcern.Majority()).
+		SetWriteConcern(writeconcern.New(writeconcern.WMajority())))
+	requireReplicaSet(t, client)
+	coll := client.Database(testDatabase).Collection(testCollection(t, client))
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("o%d", i)
+		err := mongorepo.WithCausalSession(ctx, client, func(ctx context.Context) error {
+			if err := store.Save(ctx, id, &testOrder{id, "new", i}); err != nil {
+				return err
+			}
+			order, found, err := store.Load(ctx, id)
+			if err != nil {
+				return err
+			}
+			if !found || order.Qty != i {
+				return fmt.Errorf("write of %s not visible: found=%v order=%+v", id, found, order)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package mongorepo_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+	"github.com/framework-arp/ARP4G/arp"
+)
+
+type testOrder struct {
+	Id     string `bson:"_id"`
+	Status string `bson:"status"`
+	Qty    int    `bson:"qty"`
+}
+
+func newTestOrder() *testOrder {
+	return &testOrder{}
+}
+
+//MemoryStore和MongodbStore共用的用例，保证两者行为一致
+func runStoreCases(t *testing.T, newStore func(t *testing.T) arp.Store[*testOrder]) {
+	ctx := context.Background()
+
+	t.Run("LoadAbsent", func(t *testing.T) {
+		store := newStore(t)
+		if _, found, err := store.Load(ctx, "absent"); err != nil || found {
+			t.Fatalf("Load absent: found=%v err=%v", found, err)
+		}
+	})
+
+	t.Run("SaveThenLoad", func(t *testing.T) {
+		store := newStore(t)
+		if err := store.Save(ctx, "a", &testOrder{"a", "new", 1}); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		order, found, err := store.Load(ctx, "a")
+		if err != nil || !found {
+			t.Fatalf("Load: found=%v err=%v", found, err)
+		}
+		if *order != (testOrder{"a", "new", 1}) {
+			t.Fatalf("Load = %+v", order)
+		}
+	})
+
+	t.Run("SaveExistingFails", func(t *testing.T) {
+		store := newStore(t)
+		if err := store.Save(ctx, "a", &testOrder{"a", "new", 1}); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		if err := store.Save(ctx, "a", &testOrder{"a", "new", 2}); err == nil {
+			t.Fatalf("second Save of the same id succeeded")
+		}
+	})
+
+	t.Run("SaveAllAndRemoveAllThroughRepository", func(t *testing.T) {
+		store := newStore(t)
+		repo := arp.NewRepository[*testOrder](store, arp.NewMockMutexes(), newTestOrder)
+		err := arp.Go(ctx, func(ctx context.Context) error {
+			repo.Put(ctx, "a", &testOrder{"a", "new", 1})
+			repo.Put(ctx, "b", &testOrder{"b", "new", 2})
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+		err = arp.Go(ctx, func(ctx context.Context) error {
+			order, _ := repo.Take(ctx, "a")
+			order.Qty = 5
+			repo.Remove(ctx, "b")
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("update and remove: %v", err)
+		}
+		if order, found, err := store.Load(ctx, "a"); err != nil || !found || order.Qty != 5 {
+			t.Fatalf("Load a: %+v found=%v err=%v, want qty 5", order, found, err)
+		}
+		if _, found, err := store.Load(ctx, "b"); err != nil || found {
+			t.Fatalf("Load removed b: found=%v err=%v", found, err)
+		}
+	})
+
+	t.Run("RemoveAbsent", func(t *testing.T) {
+		store := newStore(t)
+		if err := store.RemoveAll(ctx, []any{"absent"}); err != nil {
+			t.Fatalf("RemoveAll absent: %v", err)
+		}
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	runStoreCases(t, func(t *testing.T) arp.Store[*testOrder] {
+		return mongorepo.NewMemoryStore(newTestOrder)
+	})
+}
+
+func TestMongodbStore(t *testing.T) {
+	client := testClient(t)
+	runStoreCases(t, func(t *testing.T) arp.Store[*testOrder] {
+		coll := client.Database(testDatabase).Collection(testCollection(t, client))
+		return mongorepo.NewMongodbStore(coll, newTestOrder)
+	})
+}
@@ -0,0 +1,69 @@
+package mongorepo
+
+import (
+	"context"
+)
+
+//span的属性名，和OpenTelemetry数据库语义约定一致
+const (
+	SpanAttrOperation  = "db.operation"
+	SpanAttrCollection = "db.mongodb.collection"
+)
+
+//创建span的接口，很容易用OpenTelemetry的trace.Tracer适配。
+//operation为操作名（Load、Save、SaveAll、RemoveAll、Lock），返回的ctx会继续传给驱动，可以把span带下去
+type Tracer interface {
+	Start(ctx context.Context, spanName string, attributes map[string]string) (context.Context, Span)
+}
+
+//操作结束时调用End，err为操作返回的错误
+type Span interface {
+	End(err error)
+}
+
+type tracerCtxKey struct{}
+
+//返回带有tracer的ctx，使用这个ctx的操作优先使用这个tracer，而不是SetTracer设置的
+func WithTracer(ctx context.Context, tracer Tracer) context.Context {
+	return context.WithValue(ctx, tracerCtxKey{}, tracer)
+}
+
+//设置存储使用的tracer，默认没有，不创建span
+func (store *MongodbStore[T]) SetTracer(tracer Tracer) {
+	store.tracer = tracer
+}
+
+//设置锁使用的tracer，默认没有，不创建span
+func (mutexes *MongodbMutexes) SetTracer(tracer Tracer) {
+	mutexes.tracer = tracer
+}
+
+type noopSpan struct{}
+
+func (noopSpan) End(err error) {}
+
+func startSpan(ctx context.Context, tracer Tracer, operation string, collection func() string) (context.Context, Span) {
+	if ctxTracer, ok := ctx.Value(tracerCtxKey{}).(Tracer); ok && ctxTracer != nil {
+		tracer = ctxTracer
+	}
+	if tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return tracer.Start(ctx, "mongorepo."+operation, map[string]string{
+		SpanAttrOperation:  operation,
+		SpanAttrCollection: collection(),
+	})
+}
+
+func (store *MongodbStore[T]) startSpan(ctx context.Context, operation string) (context.Context, Span) {
+	return startSpan(ctx, store.tracer, operation, func() string {
+		if store.collProvider != nil {
+			return store.collProvider().Name()
+		}
+		return store.coll.Name()
+	})
+}
+
+func (mutexes *MongodbMutexes) startSpan(ctx context.Context, operation string) (context.Context, Span) {
+	return startSpan(ctx, mutexes.tracer, operation, mutexes.coll.Name)
+}
@@ -0,0 +1,81 @@
+package mongorepo_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+)
+
+type recordedSpan struct {
+	name       string
+	attributes map[string]string
+	ended      bool
+}
+
+type recordingTracer struct {
+	spans []*recordedSpan
+}
+
+func (tracer *recordingTracer) Start(ctx context.Context, spanName string, attributes map[string]string) (context.Context, mongorepo.Span) {
+	span := &recordedSpan{name: spanName, attributes: attributes}
+	tracer.spans = append(tracer.spans, span)
+	return ctx, span
+}
+
+func (span *recordedSpan) End(err error) {
+	span.ended = true
+}
+
+func TestTracingSpans(t *testing.T) {
+	ctx := context.Background()
+	//空的SaveAll和RemoveAll不访问数据库
+	coll := offlineClient(t).Database(testDatabase).Collection("orders")
+	store := mongorepo.NewMongodbStore(coll, newTestOrder)
+	tracer := &recordingTracer{}
+	store.SetTracer(tracer)
+	store.SaveAll(ctx, nil, nil)
+	store.RemoveAll(ctx, nil)
+	//ctx中的tracer优先
+	ctxTracer := &recordingTracer{}
+	store.RemoveAll(mongorepo.WithTracer(ctx, ctxTracer), nil)
+
+	if len(tracer.spans) != 2 || len(ctxTracer.spans) != 1 {
+		t.Fatalf("spans = %d and %d, want 2 and 1", len(tracer.spans), len(ctxTracer.spans))
+	}
+	for i, op := range []string{"SaveAll", "RemoveAll"} {
+		span := tracer.spans[i]
+		if span.name != "mongorepo."+op || !span.ended {
+			t.Fatalf("span %d = %+v, want mongorepo.%s ended", i, span, op)
+		}
+		if span.attributes[mongorepo.SpanAttrOperation] != op || span.attributes[mongorepo.SpanAttrCollection] != "orders" {
+			t.Fatalf("span %d attributes = %v", i, span.attributes)
+		}
+	}
+}
+
+func TestTracingSpansAroundLoadSaveAndLock(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	collection := testCollection(t, client)
+	store := mongorepo.NewMongodbStore(client.Database(testDatabase).Collection(collection), newTestOrder)
+	mutexes := mongorepo.NewMongodbMutexes(client, testDatabase, collection)
+	tracer := &recordingTracer{}
+	store.SetTracer(tracer)
+	mutexes.SetTracer(tracer)
+	store.Save(ctx, "a", &testOrder{"a", "new", 1})
+	store.Load(ctx, "a")
+	mutexes.Lock(ctx, "a")
+	want := []string{"mongorepo.Save", "mongorepo.Load", "mongorepo.Lock"}
+	if len(tracer.spans) != len(want) {
+		t.Fatalf("spans = %d, want %d", len(tracer.spans), len(want))
+	}
+	for i, name := range want {
+		if tracer.spans[i].name != name || !tracer.spans[i].ended {
+			t.Fatalf("span %d = %+v, want %s ended", i, tracer.spans[i], name)
+		}
+	}
+	if coll := tracer.spans[2].attributes[mongorepo.SpanAttrCollection]; coll != "mutexes_"+collection {
+		t.Fatalf("Lock span collection = %q", coll)
+	}
+}
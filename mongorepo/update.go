@@ -0,0 +1,104 @@
+package mongorepo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//原子地把fieldName字段加上delta，返回加完之后的值。id不存在时found为false
+func (store *MongodbStore[T]) IncrementField(ctx context.Context, id any, fieldName string, delta int64) (newValue int64, found bool, err error) {
+	filter, err := store.idFilter(id)
+	if err != nil {
+		return 0, false, err
+	}
+	update := bson.D{{"$inc", bson.D{{fieldName, delta}}}}
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.D{{fieldName, 1}})
+	raw, err := store.collection().FindOneAndUpdate(ctx, filter, update, opts).DecodeBytes()
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	newValue, ok := raw.Lookup(strings.Split(fieldName, ".")...).AsInt64OK()
+	if !ok {
+		return 0, true, fmt.Errorf("field %s is not a number", fieldName)
+	}
+	return newValue, true, nil
+}
+
+func (repo *MongodbRepository[T]) IncrementField(ctx context.Context, id any, fieldName string, delta int64) (newValue int64, found bool, err error) {
+	if repo.store == nil {
+		return 0, false, nil
+	}
+	return repo.store.IncrementField(ctx, id, fieldName, delta)
+}
+
+//向数组字段追加一个元素（允许重复）。id不存在时found为false
+func (store *MongodbStore[T]) PushToArray(ctx context.Context, id any, fieldName string, value any) (found bool, err error) {
+	return store.updateById(ctx, id, bson.D{{"$push", bson.D{{fieldName, value}}}})
+}
+
+//向数组字段追加一个元素，元素已存在则不追加。id不存在时found为false
+func (store *MongodbStore[T]) AddToSetArray(ctx context.Context, id any, fieldName string, value any) (found bool, err error) {
+	return store.updateById(ctx, id, bson.D{{"$addToSet", bson.D{{fieldName, value}}}})
+}
+
+//从数组字段中移除所有等于value的元素。id不存在时found为false
+func (store *MongodbStore[T]) PullFromArray(ctx context.Context, id any, fieldName string, value any) (found bool, err error) {
+	return store.updateById(ctx, id, bson.D{{"$pull", bson.D{{fieldName, value}}}})
+}
+
+func (store *MongodbStore[T]) updateById(ctx context.Context, id any, update any) (found bool, err error) {
+	filter, err := store.idFilter(id)
+	if err != nil {
+		return false, err
+	}
+	ur, err := store.collection().UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return ur.MatchedCount > 0, nil
+}
+
+func (repo *MongodbRepository[T]) PushToArray(ctx context.Context, id any, fieldName string, value any) (found bool, err error) {
+	if repo.store == nil {
+		return false, nil
+	}
+	return repo.store.PushToArray(ctx, id, fieldName, value)
+}
+
+func (repo *MongodbRepository[T]) AddToSetArray(ctx context.Context, id any, fieldName string, value any) (found bool, err error) {
+	if repo.store == nil {
+		return false, nil
+	}
+	return repo.store.AddToSetArray(ctx, id, fieldName, value)
+}
+
+func (repo *MongodbRepository[T]) PullFromArray(ctx context.Context, id any, fieldName string, value any) (found bool, err error) {
+	if repo.store == nil {
+		return false, nil
+	}
+	return repo.store.PullFromArray(ctx, id, fieldName, value)
+}
+
+//用聚合管道形式的更新修改文档，可以引用文档已有的字段，例如：
+//mongo.Pipeline{{{"$set", bson.D{{"total", bson.D{{"$multiply", bson.A{"$price", "$qty"}}}}}}}}
+//需要MongoDB 4.2及以上。id不存在时found为false
+func (store *MongodbStore[T]) UpdateWithPipeline(ctx context.Context, id any, pipeline mongo.Pipeline) (found bool, err error) {
+	return store.updateById(ctx, id, pipeline)
+}
+
+func (repo *MongodbRepository[T]) UpdateWithPipeline(ctx context.Context, id any, pipeline mongo.Pipeline) (found bool, err error) {
+	if repo.store == nil {
+		return false, nil
+	}
+	return repo.store.UpdateWithPipeline(ctx, id, pipeline)
+}
@@ -0,0 +1,122 @@
+package mongorepo_test
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestIncrementFieldConcurrently(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, testCollection(t, client), newTestOrder)
+	repo.InsertIfAbsent(ctx, "o1", &testOrder{"o1", "new", 0})
+	const workers = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 1; i <= workers; i++ {
+		wg.Add(1)
+		go func(delta int64) {
+			defer wg.Done()
+			if _, found, err := repo.IncrementField(ctx, "o1", "qty", delta); err != nil || !found {
+				errs <- err
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("IncrementField: %v", err)
+	}
+	want := workers * (workers + 1) / 2
+	order, _, err := repo.FindOne(ctx, bson.D{{"_id", "o1"}})
+	if err != nil || order.Qty != want {
+		t.Fatalf("qty = %d err=%v, want %d", order.Qty, err, want)
+	}
+	newValue, found, err := repo.IncrementField(ctx, "o1", "qty", -int64(want))
+	if err != nil || !found || newValue != 0 {
+		t.Fatalf("IncrementField = %d found=%v err=%v, want 0", newValue, found, err)
+	}
+	if _, found, err := repo.IncrementField(ctx, "absent", "qty", 1); err != nil || found {
+		t.Fatalf("IncrementField absent: found=%v err=%v", found, err)
+	}
+}
+
+func TestArrayUpdates(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, testCollection(t, client), func() *testTicket { return &testTicket{} })
+	repo.InsertIfAbsent(ctx, "t1", &testTicket{Id: "t1", Tags: []string{"db"}})
+	tags := func() []string {
+		ticket, _, err := repo.FindOne(ctx, bson.D{{"_id", "t1"}})
+		if err != nil {
+			t.Fatalf("FindOne: %v", err)
+		}
+		return ticket.Tags
+	}
+	for _, tag := range []string{"ui", "ui"} {
+		if found, err := repo.PushToArray(ctx, "t1", "tags", tag); err != nil || !found {
+			t.Fatalf("PushToArray: found=%v err=%v", found, err)
+		}
+	}
+	if got := tags(); !reflect.DeepEqual(got, []string{"db", "ui", "ui"}) {
+		t.Fatalf("tags after pushing a duplicate = %v, want [db ui ui]", got)
+	}
+	for _, tag := range []string{"db", "api"} {
+		if found, err := repo.AddToSetArray(ctx, "t1", "tags", tag); err != nil || !found {
+			t.Fatalf("AddToSetArray: found=%v err=%v", found, err)
+		}
+	}
+	if got := tags(); !reflect.DeepEqual(got, []string{"db", "ui", "ui", "api"}) {
+		t.Fatalf("tags after adding to set = %v, want [db ui ui api]", got)
+	}
+	if found, err := repo.PullFromArray(ctx, "t1", "tags", "ui"); err != nil || !found {
+		t.Fatalf("PullFromArray: found=%v err=%v", found, err)
+	}
+	if got := tags(); !reflect.DeepEqual(got, []string{"db", "api"}) {
+		t.Fatalf("tags after pulling = %v, want [db api]", got)
+	}
+	if found, err := repo.PushToArray(ctx, "absent", "tags", "ui"); err != nil || found {
+		t.Fatalf("PushToArray absent: found=%v err=%v", found, err)
+	}
+	if found, err := repo.AddToSetArray(ctx, "absent", "tags", "ui"); err != nil || found {
+		t.Fatalf("AddToSetArray absent: found=%v err=%v", found, err)
+	}
+	if found, err := repo.PullFromArray(ctx, "absent", "tags", "ui"); err != nil || found {
+		t.Fatalf("PullFromArray absent: found=%v err=%v", found, err)
+	}
+}
+
+type testLine struct {
+	Id    string `bson:"_id"`
+	Price int    `bson:"price"`
+	Qty   int    `bson:"qty"`
+	Total int    `bson:"total"`
+}
+
+func TestUpdateWithPipeline(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, testCollection(t, client), func() *testLine { return &testLine{} })
+	if _, err := repo.InsertIfAbsent(ctx, "l1", &testLine{Id: "l1", Price: 3, Qty: 4}); err != nil {
+		t.Fatalf("InsertIfAbsent: %v", err)
+	}
+	pipeline := mongo.Pipeline{{{"$set", bson.D{{"total", bson.D{{"$multiply", bson.A{"$price", "$qty"}}}}}}}}
+	found, err := repo.UpdateWithPipeline(ctx, "l1", pipeline)
+	if err != nil || !found {
+		t.Fatalf("UpdateWithPipeline: found=%v err=%v", found, err)
+	}
+	line, _, err := repo.FindOne(ctx, bson.D{{"_id", "l1"}})
+	if err != nil || line.Total != 12 {
+		t.Fatalf("total = %d err=%v, want 12", line.Total, err)
+	}
+	if found, err = repo.UpdateWithPipeline(ctx, "absent", pipeline); err != nil || found {
+		t.Fatalf("UpdateWithPipeline absent: found=%v err=%v", found, err)
+	}
+}
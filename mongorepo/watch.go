@@ -0,0 +1,77 @@
+package mongorepo
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//一次更新前后的实体。Err不为nil时表示这条变更解码失败或者change stream出错，出错之后channel会被关闭
+type EntityDiff[T any] struct {
+	Id     any
+	Before T
+	After  T
+	Err    error
+}
+
+//监听实体集合的更新（update和replace），每次更新发出修改前后的实体，直到ctx被取消。
+//需要MongoDB 6.0及以上的副本集，并且集合开启了前后镜像，否则Watch会失败：
+//db.runCommand({collMod: "<collection>", changeStreamPreAndPostImages: {enabled: true}})
+//前后镜像存放在config.system.preimages中，按expireAfterSeconds清理，消费太慢的话镜像可能已被清理而报错
+func (repo *MongodbRepository[T]) WatchDiffs(ctx context.Context) (<-chan EntityDiff[T], error) {
+	diffs := make(chan EntityDiff[T])
+	if repo.coll == nil {
+		close(diffs)
+		return diffs, nil
+	}
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.D{{"operationType", bson.D{{"$in", bson.A{"update", "replace"}}}}}}},
+	}
+	opts := options.ChangeStream().
+		SetFullDocument(options.Required).
+		SetFullDocumentBeforeChange(options.Required)
+	stream, err := repo.coll.Watch(ctx, pipeline, opts)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		defer close(diffs)
+		defer stream.Close(context.Background())
+		for stream.Next(ctx) {
+			select {
+			case diffs <- repo.decodeDiff(stream.Current):
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := stream.Err(); err != nil && ctx.Err() == nil {
+			select {
+			case diffs <- EntityDiff[T]{Err: err}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return diffs, nil
+}
+
+func (repo *MongodbRepository[T]) decodeDiff(event bson.Raw) (diff EntityDiff[T]) {
+	diff.Id = rawIdValue(event.Lookup("documentKey", "_id"))
+	before, ok := event.Lookup("fullDocumentBeforeChange").DocumentOK()
+	if !ok {
+		diff.Err = fmt.Errorf("change event of %v has no fullDocumentBeforeChange", diff.Id)
+		return diff
+	}
+	after, ok := event.Lookup("fullDocument").DocumentOK()
+	if !ok {
+		diff.Err = fmt.Errorf("change event of %v has no fullDocument", diff.Id)
+		return diff
+	}
+	if diff.Before, diff.Err = repo.decode(before); diff.Err != nil {
+		return diff
+	}
+	diff.After, diff.Err = repo.decode(after)
+	return diff
+}
@@ -0,0 +1,43 @@
+package mongorepo_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/framework-arp/ARP4G-mongodb/mongorepo"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestWatchDiffs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	client := testClient(t)
+	collection := testCollection(t, client)
+	db := client.Database(testDatabase)
+	err := db.RunCommand(ctx, bson.D{{"create", collection}, {"changeStreamPreAndPostImages", bson.D{{"enabled", true}}}}).Err()
+	if err != nil {
+		t.Skipf("pre- and post-images not supported: %v", err)
+	}
+	repo := mongorepo.NewMongodbRepository(client, testDatabase, collection, newTestOrder)
+	repo.InsertIfAbsent(ctx, "a", &testOrder{"a", "new", 1})
+	diffs, err := repo.WatchDiffs(ctx)
+	if err != nil {
+		t.Skipf("change streams not supported: %v", err)
+	}
+	if _, err = repo.UpdateIfPresent(ctx, "a", &testOrder{"a", "paid", 1}); err != nil {
+		t.Fatalf("UpdateIfPresent: %v", err)
+	}
+	select {
+	case diff := <-diffs:
+		if diff.Err != nil {
+			t.Fatalf("diff error: %v", diff.Err)
+		}
+		if diff.Id != "a" || diff.Before.Status != "new" || diff.After.Status != "paid" {
+			t.Fatalf("diff = %v %+v %+v", diff.Id, diff.Before, diff.After)
+		}
+	case <-ctx.Done():
+		t.Fatalf("no diff received")
+	}
+}